@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -15,6 +16,7 @@ import (
 
 func TestOneDayDifferentHours(t *testing.T) {
 	loc := time.Local
+	cachePathDir := t.TempDir() + "/"
 
 	body, err := os.ReadFile("test_data/one_day_different_hours.json")
 	require.NoError(t, err)
@@ -28,7 +30,7 @@ func TestOneDayDifferentHours(t *testing.T) {
 		startDate, endDate, err := d.ParseTime(loc)
 		require.NoError(t, err)
 
-		f, err := main.LoadOrCreateFile(t.TempDir(), strconv.Itoa(d.OutageNumber), d.OutageNumber, startDate)
+		f, err := main.LoadOrCreateFile(context.Background(), cachePathDir, strconv.Itoa(d.OutageNumber), d.OutageNumber, startDate)
 		require.NoError(t, err)
 
 		defer f.Close()
@@ -59,7 +61,7 @@ func TestOneDayDifferentHours(t *testing.T) {
 		fcf, err = d.ToFileContent(loc, "", []string{}, sequence)
 		require.NoError(t, err)
 
-		require.NoError(t, fcf.Write(f))
+		require.NoError(t, fcf.Write(context.Background(), f))
 	}
 
 	require.Equal(t, uint(1), sequence)
@@ -103,3 +105,112 @@ func TestDeleteCacheFunc(t *testing.T) {
 		}
 	}
 }
+
+func TestDeleteCacheFuncClients(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	clientDir := main.ClientCachePath(tmpDir, "home")
+	require.NoError(t, os.MkdirAll(clientDir, 0o755))
+
+	oldFile := clientDir + "old.json"
+	require.NoError(t, os.WriteFile(oldFile, []byte("old"), 0o644))
+
+	oldTime := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(oldFile, oldTime, oldTime))
+
+	main.DeleteCacheFunc(tmpDir, 24*time.Hour)()
+	require.NoFileExists(t, oldFile)
+	require.DirExists(t, clientDir)
+}
+
+func TestClientsShareBill(t *testing.T) {
+	server := newFakeSMTPServer(t, nil, false)
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{
+		Name:           "local",
+		Mail:           "barghman@example.com",
+		Address:        "127.0.0.1",
+		Port:           server.port(),
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}, time.UTC, cachePathDir)
+
+	start := time.Now().UTC().Truncate(time.Hour).Add(48 * time.Hour)
+	outage := func(recipients []string) []*main.FileContent {
+		return []*main.FileContent{{
+			BillID:              "123",
+			OutageNumber:        1,
+			StartOutageDateTime: start,
+			EndOutageDateTime:   start.Add(time.Hour),
+			Recipients:          recipients,
+		}}
+	}
+
+	home := main.Clients{BillID: "123", Recipients: []string{"a@example.com"}, Locale: main.LocaleEnglish, Location: time.UTC}
+	office := main.Clients{BillID: "123", Recipients: []string{"b@example.com"}, Locale: main.LocaleEnglish, Location: time.UTC}
+
+	// The clients don't take the recipients of each other as removed ones.
+	for range 3 {
+		main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "home", home, outage(home.Recipients))
+		main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "office", office, outage(office.Recipients))
+	}
+
+	require.Len(t, server.Messages(), 2)
+	for _, msg := range server.Messages() {
+		require.Contains(t, msg, "method=REQUEST")
+	}
+	require.Equal(t, []string{"<a@example.com>", "<b@example.com>"}, server.Recipients())
+
+	for name, recipient := range map[string]string{"home": "a@example.com", "office": "b@example.com"} {
+		content, err := os.ReadFile(main.ClientCachePath(cachePathDir, name) + main.FileName("123", 1, start))
+		require.NoError(t, err)
+
+		cached := new(main.FileContent)
+		require.NoError(t, json.Unmarshal(content, cached))
+		require.Equal(t, map[string]uint{recipient: 0}, cached.Delivered)
+	}
+}
+
+func TestMigrateCache(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	start := time.Now().UTC().Truncate(time.Hour).Add(48 * time.Hour)
+	legacy := &main.FileContent{
+		BillID:              "123",
+		OutageNumber:        1,
+		StartOutageDateTime: start,
+		EndOutageDateTime:   start.Add(time.Hour),
+		Recipients:          []string{"a@example.com", "b@example.com"},
+	}
+
+	f, err := main.LoadOrCreateFile(context.Background(), cachePathDir, legacy.BillID, legacy.OutageNumber, legacy.StartOutageDateTime)
+	require.NoError(t, err)
+	require.NoError(t, legacy.Write(context.Background(), f))
+	require.NoError(t, f.Close())
+
+	require.NoError(t, main.MigrateCache(cachePathDir, map[string]main.Clients{
+		"home":   {BillID: "123", Recipients: []string{"a@example.com"}},
+		"office": {BillIDs: []string{"123"}, Recipients: []string{"b@example.com", "c@example.com"}},
+		"other":  {BillID: "456", Recipients: []string{"a@example.com"}},
+	}))
+
+	// Each client keeps the deliveries to its own recipients, the cache of the other bills isn't copied.
+	require.NoFileExists(t, cachePathDir+legacy.FileName())
+	require.NoFileExists(t, main.ClientCachePath(cachePathDir, "other")+legacy.FileName())
+
+	for name, recipient := range map[string]string{"home": "a@example.com", "office": "b@example.com"} {
+		content, err := os.ReadFile(main.ClientCachePath(cachePathDir, name) + legacy.FileName())
+		require.NoError(t, err)
+
+		cached := new(main.FileContent)
+		require.NoError(t, json.Unmarshal(content, cached))
+		require.Equal(t, []string{recipient}, cached.Recipients)
+		require.Equal(t, map[string]uint{recipient: 0}, cached.Delivered)
+	}
+}
@@ -18,9 +18,28 @@ import (
 
 var (
 	ErrUnexpectedStatusCode    = errors.New("unexpected status code")
+	ErrAuthTokenExpired        = errors.New("auth token is expired")
 	ErrInvalidOutageDateFormat = errors.New("invalid outage date format")
+	ErrInvalidOutageRange      = errors.New("invalid outage range")
 )
 
+// MaxOutageDuration is the longest outage which is accepted, a longer one is a mistake of the provider.
+var MaxOutageDuration = 12 * time.Hour
+
+// OutageRangeError is returned by ParseTime for an outage that can't happen.
+type OutageRangeError struct {
+	Start, End time.Time
+	Reason     string
+}
+
+func (e *OutageRangeError) Error() string {
+	return fmt.Sprintf("%s: %s to %s, %s", ErrInvalidOutageRange, e.Start.Format(time.DateTime), e.End.Format(time.DateTime), e.Reason)
+}
+
+func (e *OutageRangeError) Unwrap() error {
+	return ErrInvalidOutageRange
+}
+
 const PlannedBlackOutURL = "https://uiapi.saapa.ir/api/ebills/PlannedBlackoutsReport"
 
 type PlannedBlackOutResponse struct {
@@ -55,7 +74,7 @@ type Data struct {
 }
 
 func PlannedBlackOut(ctx context.Context, authToken, billID string, startDate, endDate time.Time) ([]Data, error) {
-	slog.Debug("going to call blackout", "from time", startDate.String(), "to time", endDate.String(), "bill id", billID)
+	slog.DebugContext(ctx, "going to call blackout", "from time", startDate.String(), "to time", endDate.String(), "bill id", Sensitive(billID))
 
 	payload := PlannedBlackoutRequest{
 		BillID:   billID,
@@ -65,13 +84,13 @@ func PlannedBlackOut(ctx context.Context, authToken, billID string, startDate, e
 
 	body, err := json.Marshal(payload)
 	if err != nil {
-		slog.Error("failed to marshal request", "error", err)
+		slog.ErrorContext(ctx, "failed to marshal request", "error", err)
 		return nil, err
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, PlannedBlackOutURL, bytes.NewBuffer(body))
 	if err != nil {
-		slog.Error("failed to create new request", "error", err)
+		slog.ErrorContext(ctx, "failed to create new request", "error", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -79,35 +98,50 @@ func PlannedBlackOut(ctx context.Context, authToken, billID string, startDate, e
 	req.Header.Set("Authorization", "Bearer "+authToken)
 	req.Header.Set("Origin", "https://ios.bargheman.com")
 
+	start := time.Now()
 	response, err := http.DefaultClient.Do(req)
+	apiDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		slog.Error("failed to send request", "error", err)
+		apiRequests.Inc("error")
+		slog.ErrorContext(ctx, "failed to send request", "error", err)
 		return nil, err
 	}
 
+	apiRequests.Inc(strconv.Itoa(response.StatusCode))
+
 	defer response.Body.Close()
 
 	respbody, err := io.ReadAll(response.Body)
 	if err != nil {
-		slog.Error("failed to read response body", "error", err)
+		slog.ErrorContext(ctx, "failed to read response body", "error", err)
 		return nil, err
 	}
 
-	slog.Debug("response of barghman", "body", string(respbody))
+	slog.DebugContext(ctx, "response of barghman", "body", LogBody(respbody))
+
+	if response.StatusCode == http.StatusUnauthorized {
+		slog.ErrorContext(ctx, "auth token is rejected", "status_code", response.StatusCode)
+		return nil, ErrAuthTokenExpired
+	}
 
 	if response.StatusCode != http.StatusOK {
-		slog.Error("unexpected status code", "status_code", response.StatusCode)
+		slog.ErrorContext(ctx, "unexpected status code", "status_code", response.StatusCode)
 		return nil, ErrUnexpectedStatusCode
 	}
 
 	var plannedBlackOutResponse PlannedBlackOutResponse
 	if err := json.Unmarshal(respbody, &plannedBlackOutResponse); err != nil {
-		slog.Error("failed to decode response", "error", err)
+		slog.ErrorContext(ctx, "failed to decode response", "error", err)
 		return nil, err
 	}
 
+	if plannedBlackOutResponse.Status == http.StatusUnauthorized {
+		slog.ErrorContext(ctx, "auth token is rejected", "status_code", plannedBlackOutResponse.Status)
+		return nil, ErrAuthTokenExpired
+	}
+
 	if plannedBlackOutResponse.Status != http.StatusOK {
-		slog.Error("unexpected status code", "status_code", plannedBlackOutResponse.Status)
+		slog.ErrorContext(ctx, "unexpected status code", "status_code", plannedBlackOutResponse.Status)
 		return nil, ErrUnexpectedStatusCode
 	}
 
@@ -117,7 +151,6 @@ func PlannedBlackOut(ctx context.Context, authToken, billID string, startDate, e
 func (d Data) ToFileContent(loc *time.Location, billID string, recipients []string, sequence uint) (*FileContent, error) {
 	startDate, endDate, err := d.ParseTime(loc)
 	if err != nil {
-		slog.Error("Failed to parse data time", "error", err)
 		return nil, err
 	}
 
@@ -131,73 +164,129 @@ func (d Data) ToFileContent(loc *time.Location, billID string, recipients []stri
 		EndOutageDateTime:   endDate,
 		Recipients:          recipients,
 		Address:             d.Address,
+		OutageAddress:       d.OutageAddress,
 		ReasonOutage:        d.ReasonOutage,
+		IsPlanned:           d.IsPlanned,
 	}, nil
 }
 
+// ParseTime returns the start and the end of the outage. The date and the times may have Persian or
+// Arabic digits, surrounding spaces, "-" as the date separator and seconds; the start falls back to
+// OutageTime if OutageStartTime is empty. An outage which ends before it starts crosses midnight.
 func (d Data) ParseTime(loc *time.Location) (time.Time, time.Time, error) {
-	outdateDate := strings.Split(d.OutageDate, "/")
-	if len(outdateDate) != 3 {
-		slog.Error("invalid outage date format", "outage_date", d.OutageDate)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	year, month, day, err := parseOutageDate("outage_date", d.OutageDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
 	}
 
-	outageStartTime := strings.Split(d.OutageStartTime, ":")
-	if len(outageStartTime) != 2 {
-		slog.Error("invalid outage start time format", "outage_start_time", d.OutageStartTime)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	startField, startValue := "outage_start_time", d.OutageStartTime
+	if len(strings.TrimSpace(startValue)) == 0 {
+		startField, startValue = "outage_time", d.OutageTime
 	}
 
-	outageStopTime := strings.Split(d.OutageStopTime, ":")
-	if len(outageStopTime) != 2 {
-		slog.Error("invalid outage stop time format", "outage_stop_time", d.OutageStopTime)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	startHour, startMinute, startSecond, err := parseOutageClock(startField, startValue, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
 	}
 
-	year, err := strconv.Atoi(outdateDate[0])
+	stopHour, stopMinute, stopSecond, err := parseOutageClock("outage_stop_time", d.OutageStopTime, true)
 	if err != nil {
-		slog.Error("invalid outage date format", "outage_date", d.OutageDate)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+		return time.Time{}, time.Time{}, err
 	}
 
-	month, err := strconv.Atoi(outdateDate[1])
-	if err != nil {
-		slog.Error("invalid outage date format", "outage_date", d.OutageDate)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	startDate := ptime.Date(year, ptime.Month(month), day, startHour, startMinute, startSecond, 0, loc).Time()
+	stopDate := ptime.Date(year, ptime.Month(month), day, stopHour, stopMinute, stopSecond, 0, loc).Time()
+
+	// The outage crosses midnight, e.g. 23:00 until 01:00.
+	if !stopDate.After(startDate) {
+		stopDate = stopDate.AddDate(0, 0, 1)
 	}
 
-	day, err := strconv.Atoi(outdateDate[2])
-	if err != nil {
-		slog.Error("invalid outage date format", "outage_date", d.OutageDate)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	if stopDate.Sub(startDate) > MaxOutageDuration {
+		return time.Time{}, time.Time{}, &OutageRangeError{Start: startDate, End: stopDate, Reason: fmt.Sprintf("longer than %s", MaxOutageDuration)}
 	}
 
-	startHour, err := strconv.Atoi(outageStartTime[0])
-	if err != nil {
-		slog.Error("invalid outage start time format", "outage_start_time", d.OutageStartTime)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	return startDate, stopDate, nil
+}
+
+// OutageFieldError is returned by ParseTime for a field of the outage which can't be parsed.
+type OutageFieldError struct {
+	// Field is the json name of the field, e.g. "outage_start_time".
+	Field string
+	Value string
+}
+
+func (e *OutageFieldError) Error() string {
+	return fmt.Sprintf("%s: %s %q", ErrInvalidOutageDateFormat, e.Field, e.Value)
+}
+
+func (e *OutageFieldError) Unwrap() error {
+	return ErrInvalidOutageDateFormat
+}
+
+// splitNumbers normalizes the digits of the value and splits it into numbers by the separators.
+func splitNumbers(value, separators string) ([]int, bool) {
+	parts := strings.FieldsFunc(asciiDigits.Replace(value), func(r rune) bool {
+		return strings.ContainsRune(separators, r)
+	})
+
+	numbers := make([]int, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+
+		// Atoi accepts signs, which aren't valid here.
+		if len(part) == 0 || strings.ContainsAny(part, "+-") {
+			return nil, false
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+
+		numbers = append(numbers, n)
 	}
 
-	startMinute, err := strconv.Atoi(outageStartTime[1])
-	if err != nil {
-		slog.Error("invalid outage start time format", "outage_start_time", d.OutageStartTime)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	return numbers, true
+}
+
+// parseOutageDate parses a Jalali date, e.g. "1404/06/01", "۱۴۰۴/۰۶/۰۱" or "1404-06-01".
+func parseOutageDate(field, value string) (int, int, int, error) {
+	numbers, ok := splitNumbers(value, "/-")
+	if !ok || len(numbers) != 3 {
+		return 0, 0, 0, outageFieldError(field, value)
 	}
 
-	stopHour, err := strconv.Atoi(outageStopTime[0])
-	if err != nil {
-		slog.Error("invalid outage stop time format", "outage_stop_time", d.OutageStopTime)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	year, month, day := numbers[0], numbers[1], numbers[2]
+	if year < 1 || month < 1 || month > 12 || day < 1 || day > 31 || (month > 6 && day > 30) {
+		return 0, 0, 0, outageFieldError(field, value)
 	}
 
-	stopMinute, err := strconv.Atoi(outageStopTime[1])
-	if err != nil {
-		slog.Error("invalid outage stop time format", "outage_stop_time", d.OutageStopTime)
-		return time.Time{}, time.Time{}, ErrInvalidOutageDateFormat
+	return year, month, day, nil
+}
+
+// parseOutageClock parses a time of the day, e.g. "09:00", "۰۹:۰۰" or "09:00:00".
+// The end of the day, "24:00", is accepted if end is true.
+func parseOutageClock(field, value string, end bool) (int, int, int, error) {
+	numbers, ok := splitNumbers(value, ":")
+	if !ok || len(numbers) < 2 || len(numbers) > 3 {
+		return 0, 0, 0, outageFieldError(field, value)
+	}
+
+	numbers = append(numbers, 0)
+	hour, minute, second := numbers[0], numbers[1], numbers[2]
+
+	if hour == 24 && end && minute == 0 && second == 0 {
+		return hour, minute, second, nil
 	}
 
-	startDate := ptime.Date(year, ptime.Month(month), day, startHour, startMinute, 0, 0, loc)
-	stopDate := ptime.Date(year, ptime.Month(month), day, stopHour, stopMinute, 0, 0, loc)
+	if hour < 0 || hour > 23 || minute < 0 || minute > 59 || second < 0 || second > 59 {
+		return 0, 0, 0, outageFieldError(field, value)
+	}
+
+	return hour, minute, second, nil
+}
 
-	return startDate.Time(), stopDate.Time(), nil
+func outageFieldError(field, value string) error {
+	return &OutageFieldError{Field: field, Value: value}
 }
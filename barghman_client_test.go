@@ -0,0 +1,155 @@
+package main_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTime(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	day := time.Date(2025, time.August, 23, 0, 0, 0, 0, loc)
+
+	tests := []struct {
+		name  string
+		start string
+		stop  string
+		// wantStart and wantEnd are since the start of the day.
+		wantStart time.Duration
+		wantEnd   time.Duration
+		wantErr   error
+	}{
+		{name: "same day", start: "09:00", stop: "11:30", wantStart: 9 * time.Hour, wantEnd: 11*time.Hour + 30*time.Minute},
+		{name: "crosses midnight", start: "23:00", stop: "01:00", wantStart: 23 * time.Hour, wantEnd: 25 * time.Hour},
+		{name: "ends at midnight", start: "22:00", stop: "00:00", wantStart: 22 * time.Hour, wantEnd: 24 * time.Hour},
+		{name: "ends at 24:00", start: "22:00", stop: "24:00", wantStart: 22 * time.Hour, wantEnd: 24 * time.Hour},
+		{name: "maximum duration", start: "06:00", stop: "18:00", wantStart: 6 * time.Hour, wantEnd: 18 * time.Hour},
+		{name: "too long", start: "06:00", stop: "18:01", wantErr: main.ErrInvalidOutageRange},
+		{name: "empty range rolls to a whole day", start: "09:00", stop: "09:00", wantErr: main.ErrInvalidOutageRange},
+		{name: "stop before start is too long", start: "11:00", stop: "09:00", wantErr: main.ErrInvalidOutageRange},
+		{name: "invalid hour", start: "25:00", stop: "26:00", wantErr: main.ErrInvalidOutageDateFormat},
+		{name: "invalid minute", start: "09:60", stop: "10:00", wantErr: main.ErrInvalidOutageDateFormat},
+		{name: "after 24:00", start: "23:00", stop: "24:30", wantErr: main.ErrInvalidOutageDateFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := main.Data{OutageDate: "1404/06/01", OutageStartTime: tt.start, OutageStopTime: tt.stop}.ParseTime(loc)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, day.Add(tt.wantStart), start)
+			require.Equal(t, day.Add(tt.wantEnd), end)
+		})
+	}
+
+	_, _, err = main.Data{OutageDate: "1404/06/01", OutageStartTime: "06:00", OutageStopTime: "19:00"}.ParseTime(loc)
+
+	var rangeErr *main.OutageRangeError
+	require.True(t, errors.As(err, &rangeErr))
+	require.Equal(t, 13*time.Hour, rangeErr.End.Sub(rangeErr.Start))
+
+	for _, date := range []string{"1404/13/01", "1404/00/01", "1404/07/31", "1404/06/32"} {
+		_, _, err := main.Data{OutageDate: date, OutageStartTime: "09:00", OutageStopTime: "10:00"}.ParseTime(loc)
+		require.ErrorIs(t, err, main.ErrInvalidOutageDateFormat, date)
+	}
+}
+
+func TestParseTimeTolerant(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	start := time.Date(2025, time.August, 23, 9, 0, 0, 0, loc)
+	end := time.Date(2025, time.August, 23, 11, 30, 0, 0, loc)
+
+	for name, d := range map[string]main.Data{
+		"persian digits": {OutageDate: "۱۴۰۴/۰۶/۰۱", OutageStartTime: "۰۹:۰۰", OutageStopTime: "۱۱:۳۰"},
+		"arabic digits":  {OutageDate: "١٤٠٤/٠٦/٠١", OutageStartTime: "٠٩:٠٠", OutageStopTime: "١١:٣٠"},
+		"seconds":        {OutageDate: "1404/06/01", OutageStartTime: "09:00:00", OutageStopTime: "11:30:00"},
+		"dashes":         {OutageDate: "1404-06-01", OutageStartTime: "09:00", OutageStopTime: "11:30"},
+		"spaces":         {OutageDate: " 1404 / 06 / 01 ", OutageStartTime: " 9:00", OutageStopTime: "11:30 "},
+		"outage time":    {OutageDate: "1404/06/01", OutageTime: "09:00", OutageStopTime: "11:30"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			gotStart, gotEnd, err := d.ParseTime(loc)
+			require.NoError(t, err)
+			require.Equal(t, start, gotStart)
+			require.Equal(t, end, gotEnd)
+		})
+	}
+
+	tests := []struct {
+		data    main.Data
+		field   string
+		wantErr string
+	}{
+		{
+			data:    main.Data{OutageDate: "1404/06", OutageStartTime: "09:00", OutageStopTime: "11:30"},
+			field:   "outage_date",
+			wantErr: `invalid outage date format: outage_date "1404/06"`,
+		},
+		{
+			data:    main.Data{OutageDate: "1404/06/01", OutageStartTime: "09:00", OutageStopTime: "11:3x"},
+			field:   "outage_stop_time",
+			wantErr: `invalid outage date format: outage_stop_time "11:3x"`,
+		},
+		{
+			data:    main.Data{OutageDate: "1404/06/01", OutageStopTime: "11:30"},
+			field:   "outage_time",
+			wantErr: `invalid outage date format: outage_time ""`,
+		},
+		{
+			data:    main.Data{OutageDate: "1404/06/01", OutageStartTime: "-9:00", OutageStopTime: "11:30"},
+			field:   "outage_start_time",
+			wantErr: `invalid outage date format: outage_start_time "-9:00"`,
+		},
+	}
+
+	for _, tt := range tests {
+		_, _, err := tt.data.ParseTime(loc)
+		require.ErrorIs(t, err, main.ErrInvalidOutageDateFormat)
+		require.EqualError(t, err, tt.wantErr)
+
+		var fieldErr *main.OutageFieldError
+		require.True(t, errors.As(err, &fieldErr))
+		require.Equal(t, tt.field, fieldErr.Field)
+	}
+}
+
+func FuzzParseTime(f *testing.F) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(f, err)
+
+	f.Add("1404/06/01", "09:00", "11:30")
+	f.Add("1404/06/01", "23:00", "01:00")
+	f.Add("1404/12/29", "22:00", "24:00")
+	f.Add("1404/06/01", "09:00", "09:00")
+	f.Add("۱۴۰۴/۰۶/۰۱", "۰۹:۰۰", "۱۱:۳۰")
+	f.Add("1404-06-01", "09:00:00", "11:30:00")
+
+	f.Fuzz(func(t *testing.T, date, start, stop string) {
+		startDate, endDate, err := main.Data{OutageDate: date, OutageStartTime: start, OutageStopTime: stop}.ParseTime(loc)
+		if err != nil {
+			if !errors.Is(err, main.ErrInvalidOutageDateFormat) && !errors.Is(err, main.ErrInvalidOutageRange) {
+				t.Fatalf("unexpected error type: %v", err)
+			}
+			return
+		}
+
+		if !endDate.After(startDate) {
+			t.Fatalf("end %s isn't after start %s", endDate, startDate)
+		}
+
+		if endDate.Sub(startDate) > main.MaxOutageDuration {
+			t.Fatalf("outage of %s is longer than the maximum", endDate.Sub(startDate))
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var ErrUnknownCommand = errors.New("unknown command")
+
+// RunCommand runs the sub command given after the flags, e.g. "barghman -file config.toml outbox ls".
+func RunCommand(w io.Writer, args []string, config Config, cachePathDir string, location *time.Location, outbox *Outbox) error {
+	switch args[0] {
+	case "check":
+		return checkCommand(w, config)
+
+	case "list":
+		return listCommand(w, config, cachePathDir)
+
+	case "status":
+		return statusCommand(w, config, cachePathDir, outbox)
+
+	case "outbox":
+		return outboxCommand(w, args[1:], config, cachePathDir, location, outbox)
+
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, args[0])
+	}
+}
+
+// outboxCommand handles "outbox ls", "outbox retry [id...]" and "outbox drop <id...>".
+func outboxCommand(w io.Writer, args []string, config Config, cachePathDir string, location *time.Location, outbox *Outbox) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: outbox needs one of ls, retry, drop", ErrUnknownCommand)
+	}
+
+	switch args[0] {
+	case "ls":
+		entries, err := outbox.List()
+		if err != nil {
+			return err
+		}
+
+		// The digests don't expire.
+		format := func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+
+			return t.In(config.Location).Format(time.DateTime)
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCLIENT\tSMTP\tATTEMPTS\tNEXT ATTEMPT\tEXPIRES AT\tLAST ERROR")
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", e.ID, e.Client, e.SMTP, e.Attempts,
+				format(e.NextAttempt), format(e.ExpiresAt), e.LastError)
+		}
+
+		return tw.Flush()
+
+	case "retry":
+		send := OutboxSender(config, location, cachePathDir, time.Now)
+		if len(args) == 1 {
+			return outbox.Process(context.Background(), cachePathDir, true, send)
+		}
+
+		// Retry only the given entries.
+		ids := args[1:]
+		return outbox.Process(context.Background(), cachePathDir, true, func(ctx context.Context, e *OutboxEntry) error {
+			for _, id := range ids {
+				if id == e.ID {
+					return send(ctx, e)
+				}
+			}
+
+			return errSkipOutboxEntry
+		})
+
+	case "drop":
+		if len(args) == 1 {
+			return errors.New("outbox drop needs at least one id")
+		}
+
+		var errs []error
+		for _, id := range args[1:] {
+			if err := outbox.Drop(context.Background(), id); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", id, err))
+				continue
+			}
+
+			fmt.Fprintln(w, "dropped", id)
+		}
+
+		return errors.Join(errs...)
+
+	default:
+		return fmt.Errorf("%w: outbox %s", ErrUnknownCommand, args[0])
+	}
+}
+
+// listCommand prints the outages in the cache of each client with their status, and why the suppressed
+// ones are suppressed.
+func listCommand(w io.Writer, config Config, cachePathDir string) error {
+	clients, err := os.ReadDir(filepath.Join(cachePathDir, clientsDirName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT\tBILL\tOUTAGE\tSTART\tEND\tSEQUENCE\tSTATUS\tREASON")
+	for _, client := range clients {
+		if !client.IsDir() {
+			continue
+		}
+
+		outages, err := LoadCachedOutages(filepath.Join(cachePathDir, clientsDirName, client.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, fc := range outages {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d\t%s\t%s\n", client.Name(), strings.Join(fc.Bills(), ","), fc.OutageNumber,
+				fc.StartOutageDateTime.In(config.Location).Format("2006-01-02 15:04"), fc.EndOutageDateTime.In(config.Location).Format("15:04"),
+				fc.Sequence, fc.Status(), fc.Suppressed)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// checkCommand validates the config, the config file is already parsed at this point,
+// so it only checks the things that need more than parsing, like executing the templates.
+func checkCommand(w io.Writer, config Config) error {
+	var errs []error
+	for name, client := range config.Clients {
+		for locale, templates := range client.ParsedTemplates {
+			if err := templates.Validate(locale); err != nil {
+				errs = append(errs, fmt.Errorf("%s templates of client %s: %w", locale, name, err))
+			}
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "config is valid")
+	return nil
+}
@@ -7,71 +7,416 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/robfig/cron/v3"
 )
 
 type Config struct {
-	LogLevel int    `toml:"log_level"`
-	CronJob  string `toml:"cron_job"`
+	LogLevel LogLevel `toml:"log_level"`
+	// LogFormat is the format of the logs, "text" (default) or "json".
+	LogFormat logFormat `toml:"log_format"`
+	// LogOutput is "stderr" (default), "journald" or the path of a log file, which is rotated
+	// once it reaches LogMaxSize megabytes; LogMaxFiles of the rotated files are kept.
+	LogOutput   string `toml:"log_output"`
+	LogMaxSize  int    `toml:"log_max_size"`
+	LogMaxFiles int    `toml:"log_max_files"`
+	// LogSensitive logs the bill ids, the addresses and the bodies as they are, they're masked by default.
+	LogSensitive bool   `toml:"log_sensitive"`
+	CronJob      string `toml:"cron_job"`
 	// Deprecated. UseCron is deprecated, if the CronJob field is empty,
 	// This well known run as CronJob.
 	UseCron bool `toml:"use_cron"`
 	// WaitTime is based on second.
 	WaitTime int `toml:"wait_time"`
 	// DeleteDurationPeriod will be use for delete cache automatically.
-	DeleteDurationPeriod time.Duration      `toml:"delete_duration_period"`
-	Clients              map[string]Clients `toml:"clients"`
-	SMTP                 map[string]SMTP    `toml:"smtp"`
+	DeleteDurationPeriod time.Duration `toml:"delete_duration_period"`
+	// OutboxBaseBackoff is the wait time before retrying a failed email,
+	// it doubles on every failed attempt until it reaches OutboxMaxBackoff.
+	OutboxBaseBackoff time.Duration `toml:"outbox_base_backoff"`
+	OutboxMaxBackoff  time.Duration `toml:"outbox_max_backoff"`
+	// Timezone is the IANA timezone of the emails and the cron job, e.g. "Asia/Tehran" (default).
+	Timezone string         `toml:"timezone"`
+	Location *time.Location `toml:"-"`
+	// LookaheadDays and LookbackDays are the days after and before today which the outages
+	// are fetched for, 5 and 1 by default.
+	LookaheadDays *int `toml:"lookahead_days"`
+	LookbackDays  *int `toml:"lookback_days"`
+	// MaxRangeDays is the number of the days which are fetched in one request of the provider,
+	// longer windows are split.
+	MaxRangeDays int `toml:"max_range_days"`
+	// ListenAddress is the address of the http listener of the metrics and the health checks, e.g. "127.0.0.1:9464".
+	// It's disabled if it's empty, and it's only started by the cron job.
+	ListenAddress string `toml:"listen_address"`
+	// JobTimeout is how long a run of a client may take, a longer one is reported as stuck
+	// by /healthz and the status command.
+	JobTimeout time.Duration `toml:"job_timeout"`
+	// Templates are used by all the clients, unless the client overrides them.
+	Templates TemplateFiles      `toml:"templates"`
+	Clients   map[string]Clients `toml:"clients"`
+	SMTP      map[string]SMTP    `toml:"smtp"`
 }
 
 type SMTP struct {
-	Mail       string         `toml:"mail"`
-	Address    string         `toml:"host"`
-	Port       string         `toml:"port"`
-	From       string         `toml:"from"`
-	Username   string         `toml:"username"`
-	Password   string         `toml:"password"`
-	AuthMethod smtpAuthMethod `toml:"auth_method"`
-	Identity   string         `toml:"identity"`
-	SkipTLS    bool           `toml:"skip_tls"`
+	// Name is the key of the smtp config, e.g. "gmail" for [smtp.gmail].
+	Name string `toml:"-"`
+
+	Mail     string `toml:"mail"`
+	Address  string `toml:"host"`
+	Port     string `toml:"port"`
+	From     string `toml:"from"`
+	Username string `toml:"username"`
+	// Password and the other secrets may reference environment variables, e.g. "${SMTP_PASSWORD}",
+	// or be read from their *_file, which is relative to $CREDENTIALS_DIRECTORY if systemd sets it.
+	Password     Secret         `toml:"password"`
+	PasswordFile string         `toml:"password_file"`
+	AuthMethod   smtpAuthMethod `toml:"auth_method"`
+	Identity     string         `toml:"identity"`
+	SkipTLS      bool           `toml:"skip_tls"`
+	TLSMode      tlsMode        `toml:"tls_mode"`
+	// CAFile is a PEM bundle which is used instead of the system CAs to verify the server.
+	CAFile string `toml:"ca_file"`
+	// CertFile and KeyFile are the client certificate, for servers that require it.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// DialTimeout is the timeout of connecting to the server.
+	DialTimeout time.Duration `toml:"dial_timeout"`
+	// CommandTimeout is the timeout of each read and write on the connection.
+	CommandTimeout time.Duration `toml:"command_timeout"`
+	// MaxMessagesPerConnection is the number of messages which are sent over one
+	// connection before reconnecting, zero means no limit.
+	MaxMessagesPerConnection int `toml:"max_messages_per_connection"`
+	// DKIM options enable signing the outgoing messages, the public key should be
+	// published at "<dkim_selector>._domainkey.<dkim_domain>".
+	DKIMDomain         string      `toml:"dkim_domain"`
+	DKIMSelector       string      `toml:"dkim_selector"`
+	DKIMPrivateKeyPath string      `toml:"dkim_private_key_path"`
+	DKIMSigner         *DKIMSigner `toml:"-"`
+	// OAuth options are used by the xoauth2 auth method, OAuthProvider ("google" or "microsoft")
+	// fills the token url and scope, OAuthTokenURL and OAuthScope override them.
+	OAuthProvider         string `toml:"oauth_provider"`
+	OAuthTokenURL         string `toml:"oauth_token_url"`
+	OAuthScope            string `toml:"oauth_scope"`
+	OAuthClientID         string `toml:"oauth_client_id"`
+	OAuthClientSecret     Secret `toml:"oauth_client_secret"`
+	OAuthClientSecretFile string `toml:"oauth_client_secret_file"`
+	OAuthRefreshToken     Secret `toml:"oauth_refresh_token"`
+	OAuthRefreshTokenFile string `toml:"oauth_refresh_token_file"`
 }
 
 type Clients struct {
-	SMTP       string   `toml:"smtp"`
-	BillID     string   `toml:"bill_id"`
-	BillIDs    []string `toml:"bill_ids"`
-	AuthToken  string   `toml:"auth_token"`
-	Recipients []string `toml:"recipients"`
+	SMTP      string   `toml:"smtp"`
+	BillID    string   `toml:"bill_id"`
+	BillIDs   []string `toml:"bill_ids"`
+	AuthToken Secret   `toml:"auth_token"`
+	// AuthTokenFile is read instead of AuthToken, it's relative to $CREDENTIALS_DIRECTORY if systemd sets it.
+	AuthTokenFile string   `toml:"auth_token_file"`
+	Recipients    []string `toml:"recipients"`
+	// Locale is the language of the emails, "en" or "fa".
+	Locale Locale `toml:"locale"`
+	// RecipientLocales overrides the locale for some of the recipients, they receive a separate email.
+	RecipientLocales map[string]Locale `toml:"recipient_locales"`
+	// Mode is how the recipients receive the invites, "shared" (default), "individual" or "digest".
+	Mode clientMode `toml:"mode"`
+	// MergeSlots merges the contiguous and overlapping outages of each bill into one event.
+	MergeSlots bool `toml:"merge_slots"`
+	// Groups are the labeled groups of the bills, the same outage of the bills of a group is sent once.
+	Groups map[string][]string `toml:"groups"`
+	// GroupByAddress groups the bills which aren't in Groups by their address, or by the outage address
+	// if they don't have one.
+	GroupByAddress bool `toml:"group_by_address"`
+	// Timezone overrides the global timezone for the emails of this client.
+	Timezone string         `toml:"timezone"`
+	Location *time.Location `toml:"-"`
+	// Filter suppresses the outages which the recipients don't care about.
+	Filter OutageFilter `toml:"filter"`
+	// CronJob runs the client on its own schedule, instead of the global cron_job.
+	CronJob string `toml:"cron_job"`
+	// QuietHours are the daily hours which the notifications are deferred in, e.g. "23:00-07:00";
+	// the outages which start in them are still sent immediately.
+	QuietHours DailyRange `toml:"quiet_hours"`
+	// LookaheadDays and LookbackDays override the global window for this client.
+	LookaheadDays *int `toml:"lookahead_days"`
+	LookbackDays  *int `toml:"lookback_days"`
+	// Templates override the global templates for this client.
+	Templates       TemplateFiles         `toml:"templates"`
+	ParsedTemplates map[Locale]*Templates `toml:"-"`
 }
 
 type smtpAuthMethod string
 
 const (
-	smtpAuthMethodPlain  smtpAuthMethod = "plain"
-	smtpAuthMethodMD5    smtpAuthMethod = "cram-md5"
-	smtpAuthMethodCustom smtpAuthMethod = "custom"
+	smtpAuthMethodPlain   smtpAuthMethod = "plain"
+	smtpAuthMethodMD5     smtpAuthMethod = "cram-md5"
+	smtpAuthMethodCustom  smtpAuthMethod = "custom"
+	smtpAuthMethodNone    smtpAuthMethod = "none"
+	smtpAuthMethodXOAuth2 smtpAuthMethod = "xoauth2"
 )
 
-var smtpAuthMethodValues = []smtpAuthMethod{smtpAuthMethodPlain, smtpAuthMethodMD5, smtpAuthMethodCustom}
+type clientMode string
+
+const (
+	// clientModeShared sends one invite to all the recipients of a locale.
+	clientModeShared clientMode = "shared"
+	// clientModeIndividual sends a separate invite to each recipient, with only them as the attendee.
+	clientModeIndividual clientMode = "individual"
+	// clientModeDigest sends one email of all the upcoming outages on each run, if they're changed.
+	clientModeDigest clientMode = "digest"
+)
+
+var clientModeValues = []clientMode{clientModeShared, clientModeIndividual, clientModeDigest}
+
+var smtpAuthMethodValues = []smtpAuthMethod{smtpAuthMethodPlain, smtpAuthMethodMD5, smtpAuthMethodCustom, smtpAuthMethodNone, smtpAuthMethodXOAuth2}
 
 func ParseConfig() (*Config, error) {
 	var configFilePath string
 	flag.StringVar(&configFilePath, "file", "config.toml", "config file(toml formatted)")
 	flag.Parse()
 
+	return LoadConfig(configFilePath)
+}
+
+// LoadConfig decodes and validates the config file, and resolves its secrets.
+func LoadConfig(configFilePath string) (*Config, error) {
 	config := new(Config)
 	if _, err := toml.DecodeFile(configFilePath, config); err != nil {
 		return nil, err
 	}
 
-	for _, smtp := range config.SMTP {
+	if err := checkConfigPermissions(configFilePath, config.hasInlineSecrets()); err != nil {
+		return nil, err
+	}
+
+	if len(config.LogFormat) == 0 {
+		config.LogFormat = logFormatText
+	}
+
+	if !slices.Contains(logFormatValues, config.LogFormat) {
+		return nil, fmt.Errorf("%w %q, should be exactly one of %v", ErrInvalidLogFormat, config.LogFormat, logFormatValues)
+	}
+
+	if config.LogMaxSize == 0 {
+		config.LogMaxSize = DefaultLogMaxSize
+	}
+
+	if config.LogMaxFiles == 0 {
+		config.LogMaxFiles = DefaultLogMaxFiles
+	}
+
+	if config.LogMaxSize < 0 || config.LogMaxFiles < 0 {
+		return nil, fmt.Errorf("log_max_size and log_max_files can't be negative")
+	}
+
+	if len(config.Timezone) == 0 {
+		config.Timezone = DefaultTimezone
+	}
+
+	location, err := LoadTimezone(config.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Location = location
+
+	if config.LookaheadDays == nil {
+		lookahead := DefaultLookaheadDays
+		config.LookaheadDays = &lookahead
+	}
+
+	if config.LookbackDays == nil {
+		lookback := DefaultLookbackDays
+		config.LookbackDays = &lookback
+	}
+
+	if config.MaxRangeDays == 0 {
+		config.MaxRangeDays = DefaultMaxRangeDays
+	}
+
+	if *config.LookaheadDays < 0 || *config.LookbackDays < 0 || config.MaxRangeDays < 0 {
+		return nil, fmt.Errorf("lookahead_days, lookback_days and max_range_days can't be negative")
+	}
+
+	for name, smtp := range config.SMTP {
 		if !slices.Contains(smtpAuthMethodValues, smtp.AuthMethod) {
 			return nil, fmt.Errorf("invalid smtp auth, should be exactly one of %v", smtpAuthMethodValues)
 		}
+
+		var err error
+		if smtp.Password, err = resolveSecret("password", smtp.Password, smtp.PasswordFile); err != nil {
+			return nil, fmt.Errorf("invalid secret of smtp %s: %w", name, err)
+		}
+
+		if smtp.OAuthClientSecret, err = resolveSecret("oauth_client_secret", smtp.OAuthClientSecret, smtp.OAuthClientSecretFile); err != nil {
+			return nil, fmt.Errorf("invalid secret of smtp %s: %w", name, err)
+		}
+
+		if smtp.OAuthRefreshToken, err = resolveSecret("oauth_refresh_token", smtp.OAuthRefreshToken, smtp.OAuthRefreshTokenFile); err != nil {
+			return nil, fmt.Errorf("invalid secret of smtp %s: %w", name, err)
+		}
+
+		if smtp.AuthMethod == smtpAuthMethodXOAuth2 {
+			if _, ok := oauth2Providers[smtp.OAuthProvider]; !ok && len(smtp.OAuthTokenURL) == 0 {
+				return nil, fmt.Errorf("smtp %s needs oauth_provider or oauth_token_url for xoauth2", name)
+			}
+
+			if len(smtp.OAuthClientID) == 0 || len(smtp.OAuthRefreshToken) == 0 {
+				return nil, fmt.Errorf("smtp %s needs oauth_client_id and oauth_refresh_token for xoauth2", name)
+			}
+		}
+
+		if len(smtp.TLSMode) == 0 {
+			smtp.TLSMode = tlsModeStartTLS
+		}
+
+		if !slices.Contains(tlsModeValues, smtp.TLSMode) {
+			return nil, fmt.Errorf("invalid smtp tls mode of %s, should be exactly one of %v", name, tlsModeValues)
+		}
+
+		if _, err := smtp.TLSConfig(); err != nil {
+			return nil, fmt.Errorf("invalid tls config of smtp %s: %w", name, err)
+		}
+
+		if smtp.DialTimeout == 0 {
+			smtp.DialTimeout = 30 * time.Second
+		}
+
+		if smtp.CommandTimeout == 0 {
+			smtp.CommandTimeout = time.Minute
+		}
+
+		if len(smtp.DKIMPrivateKeyPath) != 0 {
+			if len(smtp.DKIMDomain) == 0 || len(smtp.DKIMSelector) == 0 {
+				return nil, fmt.Errorf("smtp %s needs dkim_domain and dkim_selector for dkim signing", name)
+			}
+
+			signer, err := NewDKIMSigner(smtp.DKIMDomain, smtp.DKIMSelector, smtp.DKIMPrivateKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dkim config of smtp %s: %w", name, err)
+			}
+
+			smtp.DKIMSigner = signer
+		}
+
+		smtp.Name = name
+		config.SMTP[name] = smtp
+	}
+
+	for name, client := range config.Clients {
+		authToken, err := resolveSecret("auth_token", client.AuthToken, client.AuthTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret of client %s: %w", name, err)
+		}
+
+		client.AuthToken = authToken
+
+		if len(client.Locale) == 0 {
+			client.Locale = LocaleEnglish
+		}
+
+		if len(client.Mode) == 0 {
+			client.Mode = clientModeShared
+		}
+
+		if !slices.Contains(clientModeValues, client.Mode) {
+			return nil, fmt.Errorf("invalid mode %q of client %s, should be exactly one of %v", client.Mode, name, clientModeValues)
+		}
+
+		client.Location = config.Location
+		if len(client.Timezone) != 0 {
+			location, err := LoadTimezone(client.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timezone of client %s: %w", name, err)
+			}
+
+			client.Location = location
+		}
+
+		if client.LookaheadDays == nil {
+			client.LookaheadDays = config.LookaheadDays
+		}
+
+		if client.LookbackDays == nil {
+			client.LookbackDays = config.LookbackDays
+		}
+
+		if *client.LookaheadDays < 0 || *client.LookbackDays < 0 {
+			return nil, fmt.Errorf("lookahead_days and lookback_days of client %s can't be negative", name)
+		}
+
+		if len(client.CronJob) != 0 {
+			if _, err := cron.ParseStandard(client.Schedule()); err != nil {
+				return nil, fmt.Errorf("invalid cron_job of client %s: %w", name, err)
+			}
+		}
+
+		grouped := make(map[string]string)
+		for label, bills := range client.Groups {
+			for _, bill := range bills {
+				if !slices.Contains(client.BillIDs, bill) && client.BillID != bill {
+					return nil, fmt.Errorf("bill %s of group %s isn't a bill of client %s", bill, label, name)
+				}
+
+				if other, ok := grouped[bill]; ok && other != label {
+					return nil, fmt.Errorf("bill %s of client %s is in both groups %s and %s", bill, name, other, label)
+				}
+
+				grouped[bill] = label
+			}
+		}
+
+		for _, locale := range client.Locales() {
+			if !slices.Contains(localeValues, locale) {
+				return nil, fmt.Errorf("invalid locale %q of client %s, should be exactly one of %v", locale, name, localeValues)
+			}
+		}
+
+		client.ParsedTemplates = make(map[Locale]*Templates)
+		for _, locale := range client.Locales() {
+			templates, err := LoadTemplates(config.Templates.Merge(client.Templates), locale)
+			if err != nil {
+				return nil, fmt.Errorf("invalid templates of client %s: %w", name, err)
+			}
+
+			client.ParsedTemplates[locale] = templates
+		}
+
+		config.Clients[name] = client
 	}
 
 	if config.DeleteDurationPeriod == 0 {
 		config.DeleteDurationPeriod = time.Hour * 24 * 7
 	}
 
+	if config.JobTimeout == 0 {
+		config.JobTimeout = DefaultJobTimeout
+	}
+
+	if config.OutboxBaseBackoff == 0 {
+		config.OutboxBaseBackoff = time.Minute
+	}
+
+	if config.OutboxMaxBackoff == 0 {
+		config.OutboxMaxBackoff = time.Hour
+	}
+
+	if config.OutboxMaxBackoff < config.OutboxBaseBackoff {
+		return nil, fmt.Errorf("outbox_max_backoff (%s) is less than outbox_base_backoff (%s)", config.OutboxMaxBackoff, config.OutboxBaseBackoff)
+	}
+
 	return config, nil
 }
+
+// hasInlineSecrets reports whether any of the secrets is written in the config file itself.
+func (c *Config) hasInlineSecrets() bool {
+	for _, smtp := range c.SMTP {
+		if isInlineSecret(smtp.Password) || isInlineSecret(smtp.OAuthClientSecret) || isInlineSecret(smtp.OAuthRefreshToken) {
+			return true
+		}
+	}
+
+	for _, client := range c.Clients {
+		if isInlineSecret(client.AuthToken) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// addressReplacer unifies the Arabic and Persian variants of the letters and digits,
+// and removes the zero width characters.
+var addressReplacer = strings.NewReplacer(
+	"ي", "ی", "ى", "ی", "ك", "ک", "ة", "ه", "أ", "ا", "إ", "ا", "آ", "ا",
+	"‌", " ", "‍", "", "‏", "", "‎", "",
+	"۰", "0", "۱", "1", "۲", "2", "۳", "3", "۴", "4", "۵", "5", "۶", "6", "۷", "7", "۸", "8", "۹", "9",
+	"٠", "0", "١", "1", "٢", "2", "٣", "3", "٤", "4", "٥", "5", "٦", "6", "٧", "7", "٨", "8", "٩", "9",
+)
+
+// NormalizeAddress returns the address without the differences which don't matter, e.g. the
+// letter variants, the punctuation and the extra spaces, so the same address of two bills is equal.
+func NormalizeAddress(address string) string {
+	address = strings.ToLower(addressReplacer.Replace(address))
+
+	address = strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return ' '
+		}
+
+		return r
+	}, address)
+
+	return strings.Join(strings.Fields(address), " ")
+}
+
+// Bills returns the bills which the outage affects.
+func (f *FileContent) Bills() []string {
+	if len(f.BillIDs) != 0 {
+		return f.BillIDs
+	}
+
+	return []string{f.BillID}
+}
+
+// Grouped reports whether the outages of the bills of the client are deduplicated.
+func (c Clients) Grouped() bool {
+	return len(c.Groups) != 0 || c.GroupByAddress
+}
+
+// group returns the group of the bill of the outage, the explicit groups of the client come first.
+func (c Clients) group(fc *FileContent) string {
+	for label, bills := range c.Groups {
+		if slices.Contains(bills, fc.BillID) {
+			return "group:" + label
+		}
+	}
+
+	// The address of the bill is preferred, the outage address is the area of the outage which
+	// the bills of different buildings might share.
+	if c.GroupByAddress {
+		if address := NormalizeAddress(fc.Address); len(address) != 0 {
+			return "address:" + address
+		}
+
+		if address := NormalizeAddress(fc.OutageAddress); len(address) != 0 {
+			return "outage_address:" + address
+		}
+	}
+
+	return "bill:" + fc.BillID
+}
+
+// Deduplicate merges the outages of the bills in the same group which have the same time window,
+// the outage of the first bill is kept and lists all of the bills in its BillIDs.
+func (c Clients) Deduplicate(outages []*FileContent) []*FileContent {
+	type window struct {
+		group      string
+		start, end time.Time
+	}
+
+	var deduplicated []*FileContent
+	seen := make(map[window]*FileContent)
+	for _, fc := range outages {
+		key := window{group: c.group(fc), start: fc.StartOutageDateTime.UTC(), end: fc.EndOutageDateTime.UTC()}
+
+		if first, ok := seen[key]; ok {
+			if !slices.Contains(first.Bills(), fc.BillID) {
+				first.BillIDs = append(first.Bills(), fc.BillID)
+			}
+
+			first.Address = appendDistinct(first.Address, fc.Address)
+			first.OutageAddress = appendDistinct(first.OutageAddress, fc.OutageAddress)
+			first.ReasonOutage = appendDistinct(first.ReasonOutage, fc.ReasonOutage)
+			first.IsPlanned = first.IsPlanned && fc.IsPlanned
+			continue
+		}
+
+		d := *fc
+		seen[key] = &d
+		deduplicated = append(deduplicated, &d)
+	}
+
+	return deduplicated
+}
+
+// supersedeDuplicates cancels the cached outages of the other bills of the outage which have
+// the same time window, they're sent before the bills are grouped.
+func supersedeDuplicates(ctx context.Context, mail Mail, outbox *Outbox, cachePathDir, clientName string, client Clients, fc *FileContent) {
+	for _, billID := range fc.Bills() {
+		if billID == fc.BillID {
+			continue
+		}
+
+		pattern := fmt.Sprintf("%s%s_*_%s.json", cachePathDir, billID, fc.StartOutageDateTime.Format(time.DateOnly))
+
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to find cached outages", "error", err, "pattern", SensitivePath(pattern))
+			continue
+		}
+
+		for _, path := range paths {
+			content, err := os.ReadFile(path)
+			if err != nil || len(content) == 0 {
+				continue
+			}
+
+			cached := new(FileContent)
+			if err := json.Unmarshal(content, cached); err != nil {
+				slog.ErrorContext(ctx, "decode the file data failed", "error", err, "file path", SensitivePath(path))
+				continue
+			}
+
+			if cached.StartOutageDateTime.Equal(fc.StartOutageDateTime) && cached.EndOutageDateTime.Equal(fc.EndOutageDateTime) {
+				supersede(ctx, mail, outbox, cachePathDir, clientName, client, cached)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	require.Equal(t, main.NormalizeAddress("تهران، خیابان ولیعصر - پلاک ۱۲"), main.NormalizeAddress("  تهران خيابان  ولیعصر، پلاك 12 "))
+	require.Equal(t, "home sweet home", main.NormalizeAddress("HOME,  Sweet-Home."))
+	require.NotEqual(t, main.NormalizeAddress("پلاک ۱۲"), main.NormalizeAddress("پلاک ۱۳"))
+}
+
+func TestDeduplicate(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	var outages []*main.FileContent
+	for _, d := range []struct {
+		billID  string
+		address string
+		start   string
+		stop    string
+	}{
+		{"111", "پلاک ۱۲", "09:00", "11:00"},
+		{"222", "پلاك 12", "09:00", "11:00"},
+		{"333", "پلاک ۱۲", "09:00", "11:00"},
+		{"222", "پلاك 12", "14:00", "15:00"},
+		{"444", "HOME", "09:00", "11:00"},
+	} {
+		fc, err := main.Data{OutageDate: "1404/06/01", OutageStartTime: d.start, OutageStopTime: d.stop, OutageNumber: 1, Address: d.address}.
+			ToFileContent(loc, d.billID, []string{"someone@example.com"}, 0)
+		require.NoError(t, err)
+
+		outages = append(outages, fc)
+	}
+
+	client := main.Clients{BillIDs: []string{"111", "222", "333", "444"}}
+	require.Len(t, client.Deduplicate(outages), 5, "bills aren't grouped by default")
+
+	client.GroupByAddress = true
+	deduplicated := client.Deduplicate(outages)
+	require.Len(t, deduplicated, 3)
+	require.Equal(t, []string{"111", "222", "333"}, deduplicated[0].Bills())
+	require.Equal(t, "پلاک ۱۲", deduplicated[0].Address)
+	require.Equal(t, []string{"222"}, deduplicated[1].Bills())
+	require.Equal(t, []string{"444"}, deduplicated[2].Bills())
+
+	// The explicit groups come first.
+	client.Groups = map[string][]string{"building": {"333", "444"}}
+	deduplicated = client.Deduplicate(outages)
+	require.Len(t, deduplicated, 3)
+	require.Equal(t, []string{"111", "222"}, deduplicated[0].Bills())
+	require.Equal(t, []string{"333", "444"}, deduplicated[1].Bills())
+	require.Equal(t, "پلاک ۱۲ / HOME", deduplicated[1].Address)
+
+	// The outages aren't changed.
+	require.Empty(t, outages[0].BillIDs)
+
+	templates, err := main.LoadTemplates(main.TemplateFiles{}, main.LocalePersian)
+	require.NoError(t, err)
+
+	rendered, err := templates.Render(main.TemplateData{FileContent: deduplicated[1], Client: "my_client", Location: loc, Locale: main.LocalePersian})
+	require.NoError(t, err)
+	require.Contains(t, rendered.Description, "قبض‌ها: ۳۳۳، ۴۴۴")
+
+	// The bills without an address are grouped by their outage address.
+	outages = nil
+	for _, billID := range []string{"555", "666"} {
+		fc, err := main.Data{OutageDate: "1404/06/01", OutageStartTime: "09:00", OutageStopTime: "11:00", OutageNumber: 1, OutageAddress: "خیابان آزادی"}.
+			ToFileContent(loc, billID, []string{"someone@example.com"}, 0)
+		require.NoError(t, err)
+
+		outages = append(outages, fc)
+	}
+
+	require.Equal(t, "خیابان آزادی", outages[0].OutageAddress)
+
+	deduplicated = main.Clients{BillIDs: []string{"555", "666"}, GroupByAddress: true}.Deduplicate(outages)
+	require.Len(t, deduplicated, 1)
+	require.Equal(t, []string{"555", "666"}, deduplicated[0].Bills())
+}
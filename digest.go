@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DigestState is the last digest which is sent to the recipients of a client,
+// the digest isn't sent again until its fingerprint changes.
+type DigestState struct {
+	Fingerprint string    `json:"fingerprint"`
+	Outages     int       `json:"outages"`
+	SentAt      time.Time `json:"sent_at"`
+	// Groups are the fingerprints of the last digest which each recipient group got, by their locale,
+	// so only the failed groups get it again.
+	Groups map[Locale]string `json:"groups,omitempty"`
+	// Ends are the end times of the outages of the last digest by their lines in the fingerprint,
+	// the outages which are ended since then don't change the digest.
+	Ends map[string]time.Time `json:"ends,omitempty"`
+}
+
+// DigestData is passed to the digest templates.
+type DigestData struct {
+	// Client is the name of the client, e.g. "my_client" for [clients.my_client].
+	Client   string
+	Location *time.Location
+	Locale   Locale
+	// Days are the days which have outages, sorted by date.
+	Days []DigestDay
+}
+
+// DigestDay is the outages of a single day, sorted by their start time.
+type DigestDay struct {
+	Outages []TemplateData
+	Locale  Locale
+}
+
+// NewDigestData groups the outages by their day in the location.
+func NewDigestData(outages []*FileContent, client string, location *time.Location, locale Locale) DigestData {
+	outages = slices.Clone(outages)
+	slices.SortStableFunc(outages, func(a, b *FileContent) int {
+		return a.StartOutageDateTime.Compare(b.StartOutageDateTime)
+	})
+
+	data := DigestData{Client: client, Location: location, Locale: locale}
+	for _, fc := range outages {
+		day := fc.StartOutageDateTime.In(location).Format(time.DateOnly)
+
+		if len(data.Days) == 0 || data.Days[len(data.Days)-1].Outages[0].start().Format(time.DateOnly) != day {
+			data.Days = append(data.Days, DigestDay{Locale: locale})
+		}
+
+		last := &data.Days[len(data.Days)-1]
+		last.Outages = append(last.Outages, TemplateData{FileContent: fc, Client: client, Location: location, Locale: locale})
+	}
+
+	return data
+}
+
+// JalaliDate returns the date of the day in the Jalali calendar, e.g. "1404/06/01" or "۱۴۰۴/۰۶/۰۱".
+func (d DigestDay) JalaliDate() string {
+	return d.Outages[0].JalaliDate()
+}
+
+// JalaliLongDate returns the date of the day with the names of the weekday and the month.
+func (d DigestDay) JalaliLongDate() string {
+	return d.Outages[0].JalaliLongDate()
+}
+
+// GregorianDate returns the date of the day in the Gregorian calendar.
+func (d DigestDay) GregorianDate() string {
+	return d.Outages[0].GregorianDate()
+}
+
+// Total returns how long the power is out during the day, the overlapping outages
+// are counted once, e.g. "4 hours 30 minutes" or "۴ ساعت و ۳۰ دقیقه".
+func (d DigestDay) Total() string {
+	var (
+		total    time.Duration
+		end      time.Time
+		outageAt time.Time
+	)
+
+	// The outages are sorted by their start time.
+	for _, outage := range d.Outages {
+		if outage.StartOutageDateTime.After(end) {
+			total += end.Sub(outageAt)
+			outageAt = outage.StartOutageDateTime
+		}
+
+		if outage.EndOutageDateTime.After(end) {
+			end = outage.EndOutageDateTime
+		}
+	}
+
+	total += end.Sub(outageAt)
+
+	return d.Locale.Duration(total)
+}
+
+// DigestFingerprint identifies the outages and the recipients of a digest.
+func DigestFingerprint(outages []*FileContent, recipients []string) string {
+	var lines []string
+	for _, fc := range outages {
+		lines = append(lines, digestLine(fc))
+	}
+
+	return digestFingerprint(lines, recipients)
+}
+
+func digestLine(fc *FileContent) string {
+	return fmt.Sprintf("%s|%d|%s|%s|%s|%s", fc.BillID, fc.OutageNumber,
+		fc.StartOutageDateTime.UTC().Format(time.RFC3339), fc.EndOutageDateTime.UTC().Format(time.RFC3339),
+		fc.Address, fc.ReasonOutage)
+}
+
+func digestFingerprint(lines, recipients []string) string {
+	lines = slices.Clone(lines)
+	slices.Sort(lines)
+	recipients = slices.Clone(recipients)
+	slices.Sort(recipients)
+
+	return fingerprint(strings.Join(lines, "\n") + "\n" + strings.Join(recipients, ","))
+}
+
+// Unchanged reports whether the recipients which got the digest with the fingerprint don't need
+// a new one for the outages. The outages of the last digest which are ended by now aren't a change.
+func (s *DigestState) Unchanged(got string, outages []*FileContent, recipients []string, now time.Time) bool {
+	current := DigestFingerprint(outages, recipients)
+	if got == current {
+		return true
+	}
+
+	if len(s.Ends) == 0 || got != digestFingerprint(slices.Collect(maps.Keys(s.Ends)), recipients) {
+		return false
+	}
+
+	var upcoming []string
+	for line, end := range s.Ends {
+		if end.After(now) {
+			upcoming = append(upcoming, line)
+		}
+	}
+
+	return current == digestFingerprint(upcoming, recipients)
+}
+
+// SetOutages keeps the end times of the outages of the digest.
+func (s *DigestState) SetOutages(outages []*FileContent) {
+	s.Ends = make(map[string]time.Time, len(outages))
+	for _, fc := range outages {
+		s.Ends[digestLine(fc)] = fc.EndOutageDateTime
+	}
+}
+
+func digestStatePath(cachePathDir, client string) string {
+	return filepath.Join(cachePathDir, "digest", safeFileName(client)+".json")
+}
+
+// LoadDigestState returns the state of the last digest of the client, it's empty if
+// no digest is sent yet.
+func LoadDigestState(ctx context.Context, cachePathDir, client string) (*DigestState, error) {
+	content, err := os.ReadFile(digestStatePath(cachePathDir, client))
+	if errors.Is(err, os.ErrNotExist) {
+		return new(DigestState), nil
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read digest state", "error", err)
+		return nil, err
+	}
+
+	state := new(DigestState)
+	if err := json.Unmarshal(content, state); err != nil {
+		slog.ErrorContext(ctx, "decode the digest state failed", "error", err)
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Save writes the state of the digest of the client.
+func (s *DigestState) Save(ctx context.Context, cachePathDir, client string) error {
+	path := digestStatePath(cachePathDir, client)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		slog.ErrorContext(ctx, "cannot create digest directory", "error", err)
+		return err
+	}
+
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		slog.ErrorContext(ctx, "Failed to write digest state", "error", err)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
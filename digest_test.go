@@ -0,0 +1,259 @@
+package main_test
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func digestOutages(t *testing.T, loc *time.Location) []*main.FileContent {
+	t.Helper()
+
+	var outages []*main.FileContent
+	for i, d := range []main.Data{
+		{OutageDate: "1404/06/02", OutageStartTime: "10:00", OutageStopTime: "12:00", OutageNumber: 3, Address: "HOME"},
+		{OutageDate: "1404/06/01", OutageStartTime: "09:00", OutageStopTime: "11:00", OutageNumber: 1, Address: "HOME"},
+		{OutageDate: "1404/06/01", OutageStartTime: "10:00", OutageStopTime: "12:30", OutageNumber: 2, Address: "WORK"},
+	} {
+		fc, err := d.ToFileContent(loc, []string{"123", "456", "456"}[i], []string{"someone@example.com"}, 0)
+		require.NoError(t, err)
+
+		outages = append(outages, fc)
+	}
+
+	return outages
+}
+
+func TestDigestData(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	data := main.NewDigestData(digestOutages(t, loc), "my_client", loc, main.LocaleEnglish)
+	require.Len(t, data.Days, 2)
+
+	require.Equal(t, "Shanbeh 1 Shahrivar 1404", data.Days[0].JalaliLongDate())
+	require.Len(t, data.Days[0].Outages, 2)
+	require.Equal(t, 1, data.Days[0].Outages[0].OutageNumber)
+	// The overlapping outages are counted once.
+	require.Equal(t, "3 hours 30 minutes", data.Days[0].Total())
+
+	require.Equal(t, "1404/06/02", data.Days[1].JalaliDate())
+	require.Equal(t, "2 hours", data.Days[1].Total())
+
+	data = main.NewDigestData(digestOutages(t, loc), "my_client", loc, main.LocalePersian)
+	require.Equal(t, "۳ ساعت و ۳۰ دقیقه", data.Days[0].Total())
+}
+
+func TestDigestState(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	cachePathDir := t.TempDir() + "/"
+	outages := digestOutages(t, loc)
+
+	state, err := main.LoadDigestState(context.Background(), cachePathDir, "my_client")
+	require.NoError(t, err)
+	require.Empty(t, state.Fingerprint)
+
+	fingerprint := main.DigestFingerprint(outages, []string{"a@example.com", "b@example.com"})
+	require.Equal(t, fingerprint, main.DigestFingerprint([]*main.FileContent{outages[2], outages[0], outages[1]}, []string{"b@example.com", "a@example.com"}))
+	require.NotEqual(t, fingerprint, main.DigestFingerprint(outages[1:], []string{"a@example.com", "b@example.com"}))
+	require.NotEqual(t, fingerprint, main.DigestFingerprint(outages, []string{"a@example.com"}))
+
+	require.NoError(t, (&main.DigestState{Fingerprint: fingerprint, Outages: len(outages)}).Save(context.Background(), cachePathDir, "my_client"))
+
+	state, err = main.LoadDigestState(context.Background(), cachePathDir, "my_client")
+	require.NoError(t, err)
+	require.Equal(t, fingerprint, state.Fingerprint)
+}
+
+func TestDeliverDigest(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	server := newFakeSMTPServer(t, nil, false)
+	server.reject = "b@example.com"
+
+	mail := main.NewMailClient(main.SMTP{
+		Name:           "local",
+		Mail:           "barghman@example.com",
+		Address:        "127.0.0.1",
+		Port:           server.port(),
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}, loc, t.TempDir())
+
+	client := main.Clients{
+		Recipients:       []string{"a@example.com", "b@example.com"},
+		Locale:           main.LocaleEnglish,
+		RecipientLocales: map[string]main.Locale{"b@example.com": main.LocalePersian},
+		Location:         loc,
+	}
+
+	cachePathDir := t.TempDir() + "/"
+	outages := digestOutages(t, loc)
+	now := outages[1].StartOutageDateTime.Add(-24 * time.Hour)
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	// The persian group fails, the english one gets the digest.
+	require.Error(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, now))
+	require.Len(t, server.Messages(), 1)
+
+	// Only the failed group gets it on the next run.
+	server.mu.Lock()
+	server.reject = ""
+	server.mu.Unlock()
+
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, now))
+	require.Len(t, server.Messages(), 2)
+	require.Equal(t, []string{"<a@example.com>", "<b@example.com>", "<b@example.com>"}, server.Recipients())
+
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, now))
+	require.Len(t, server.Messages(), 2)
+
+	// A changed digest is sent to all the groups again.
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages[1:], now))
+	require.Len(t, server.Messages(), 4)
+}
+
+func TestDeliverDigestExpired(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	server := newFakeSMTPServer(t, nil, false)
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{
+		Name:           "local",
+		Mail:           "barghman@example.com",
+		Address:        "127.0.0.1",
+		Port:           server.port(),
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}, loc, cachePathDir)
+
+	client := main.Clients{Recipients: []string{"a@example.com"}, Locale: main.LocaleEnglish, Location: loc}
+	outages := digestOutages(t, loc)
+
+	now := outages[1].StartOutageDateTime.Add(-time.Hour)
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, now))
+	require.Len(t, server.Messages(), 1)
+
+	// The outages which end since the last digest don't change it.
+	now = outages[1].EndOutageDateTime.Add(time.Minute)
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, now))
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, []*main.FileContent{outages[0], outages[2]}, now))
+	require.Len(t, server.Messages(), 1)
+
+	now = outages[0].EndOutageDateTime.Add(time.Minute)
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, nil, now))
+	require.Len(t, server.Messages(), 1)
+
+	// A changed upcoming outage is still sent.
+	now = outages[1].EndOutageDateTime.Add(time.Minute)
+	moved := *outages[0]
+	moved.EndOutageDateTime = moved.EndOutageDateTime.Add(time.Hour)
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, []*main.FileContent{outages[2], &moved}, now))
+	require.Len(t, server.Messages(), 2)
+}
+
+func TestDeliverDigestQuietHours(t *testing.T) {
+	server := newFakeSMTPServer(t, nil, false)
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	smtp := main.SMTP{
+		Name:           "local",
+		Mail:           "barghman@example.com",
+		Address:        "127.0.0.1",
+		Port:           server.port(),
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}
+
+	// The quiet hours are from an hour ago until two hours later, they might cross midnight.
+	now := time.Now().UTC()
+	since := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	client := main.Clients{
+		SMTP:       "local",
+		Recipients: []string{"a@example.com"},
+		Locale:     main.LocaleEnglish,
+		Location:   time.UTC,
+		QuietHours: main.DailyRange{Start: (since + 23*time.Hour) % (24 * time.Hour), End: (since + 2*time.Hour) % (24 * time.Hour)},
+	}
+
+	outages := []*main.FileContent{{
+		BillID:              "123",
+		OutageNumber:        1,
+		StartOutageDateTime: now.Add(48 * time.Hour),
+		EndOutageDateTime:   now.Add(50 * time.Hour),
+		Recipients:          client.Recipients,
+	}}
+
+	mail := main.NewMailClient(smtp, time.UTC, cachePathDir)
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, time.Now()))
+	require.Empty(t, server.Messages())
+
+	entries, err := outbox.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// The outbox sends it once the quiet hours end, and records it for the group.
+	config := main.Config{SMTP: map[string]main.SMTP{"local": smtp}, Clients: map[string]main.Clients{"my_client": client}}
+	after := func() time.Time { return now.Add(3 * time.Hour) }
+	require.NoError(t, outbox.Process(context.Background(), cachePathDir, true, main.OutboxSender(config, time.UTC, cachePathDir, after)))
+	require.Len(t, server.Messages(), 1)
+
+	state, err := main.LoadDigestState(context.Background(), cachePathDir, "my_client")
+	require.NoError(t, err)
+	require.Equal(t, main.DigestFingerprint(outages, client.Recipients), state.Groups[main.LocaleEnglish])
+
+	// The next run doesn't defer it again.
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, time.Now()))
+	entries, err = outbox.List()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.Len(t, server.Messages(), 1)
+}
+
+func TestMailBuildDigest(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{Mail: "barghman@example.com", From: "Barghman"}, loc, t.TempDir())
+	msg, err := mail.BuildDigest(context.Background(), digestOutages(t, loc), []string{"someone@example.com"}, "my_client", main.LocaleEnglish)
+	require.NoError(t, err)
+
+	require.Contains(t, msg, "Subject: Power Outage Digest of my_client\r\n")
+	require.Contains(t, msg, `filename=outages.ics`)
+	require.NotContains(t, msg, "text/calendar")
+
+	_, attachment, ok := strings.Cut(msg, "filename=outages.ics\r\n\r\n")
+	require.True(t, ok)
+
+	attachment, _, _ = strings.Cut(attachment, "\r\n--")
+	calendar, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(attachment, "\r\n", ""))
+	require.NoError(t, err)
+
+	require.Contains(t, string(calendar), "METHOD:PUBLISH\r\n")
+	require.Equal(t, 3, strings.Count(string(calendar), "BEGIN:VEVENT"))
+	require.NotContains(t, string(calendar), "ATTENDEE")
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDKIMInvalidKey     = errors.New("invalid dkim private key")
+	ErrDKIMInvalidMessage = errors.New("invalid message, no header and body separator")
+)
+
+// dkimSignedHeaders are signed if the message has them, Bcc is never signed.
+var dkimSignedHeaders = []string{"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "MIME-Version", "Content-Type"}
+
+// DKIMSigner signs messages with relaxed/relaxed canonicalization (RFC 6376),
+// using RSA or Ed25519 (RFC 8463) keys.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+}
+
+func NewDKIMSigner(domain, selector, keyPath string) (*DKIMSigner, error) {
+	content, err := os.ReadFile(keyPath)
+	if err != nil {
+		slog.Error("can't read dkim private key", "error", err, "path", keyPath)
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block in %s", ErrDKIMInvalidKey, keyPath)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDKIMInvalidKey, err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 1024 {
+			slog.Warn("dkim rsa key is too short, receivers may ignore the signature", "bits", key.N.BitLen())
+		}
+
+		return &DKIMSigner{Domain: domain, Selector: selector, Key: key}, nil
+
+	case ed25519.PrivateKey:
+		return &DKIMSigner{Domain: domain, Selector: selector, Key: key}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %T", ErrDKIMInvalidKey, key)
+	}
+}
+
+func (s *DKIMSigner) algorithm() string {
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+
+	return "rsa-sha256"
+}
+
+// Sign returns the message with the DKIM-Signature header prepended.
+func (s *DKIMSigner) Sign(msg string) (string, error) {
+	header, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		return "", ErrDKIMInvalidMessage
+	}
+
+	fields := splitHeaderFields(header + "\r\n")
+
+	// Sign the headers from the bottom up, as verifiers pick them in that order.
+	var names []string
+	var signed strings.Builder
+	for _, name := range dkimSignedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fieldName, _, _ := strings.Cut(fields[i], ":"); strings.EqualFold(strings.TrimSpace(fieldName), name) {
+				names = append(names, strings.ToLower(name))
+				signed.WriteString(relaxedHeader(fields[i]) + "\r\n")
+			}
+		}
+	}
+
+	bodyHash := sha256.Sum256([]byte(relaxedBody(body)))
+
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.algorithm(), s.Domain, s.Selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	signed.WriteString(relaxedHeader("DKIM-Signature: " + value))
+	hash := sha256.Sum256([]byte(signed.String()))
+
+	var signature []byte
+	var err error
+	switch key := s.Key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, hash[:])
+	default:
+		signature, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return "DKIM-Signature: " + value + base64.StdEncoding.EncodeToString(signature) + "\r\n" + msg, nil
+}
+
+// splitHeaderFields splits the header into its fields, keeping the folded lines together.
+func splitHeaderFields(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if len(line) == 0 {
+			continue
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) != 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+
+		fields = append(fields, line)
+	}
+
+	return fields
+}
+
+// relaxedHeader canonicalizes a header field, without the trailing CRLF.
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+
+	value = strings.Trim(compressWSP(strings.ReplaceAll(value, "\r\n", "")), " ")
+
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value
+}
+
+// relaxedBody canonicalizes the body.
+func relaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		lines[i] = compressWSP(line)
+	}
+
+	// Ignore all the empty lines at the end of the body.
+	for len(lines) != 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// compressWSP replaces every sequence of spaces and tabs with a single space.
+func compressWSP(s string) string {
+	var b strings.Builder
+	wsp := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			wsp = true
+			continue
+		}
+
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+
+		b.WriteRune(r)
+	}
+
+	if wsp {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
@@ -0,0 +1,168 @@
+package main_test
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+const dkimTestMessage = "From: Barghman <barghman@example.com>\r\n" +
+	"To: barghman@example.com\r\n" +
+	"Subject:  Scheduled   Power Outage\r\n" +
+	"\ton 1404/06/01\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
+	"\r\n" +
+	"Power  outage \t \r\n" +
+	"from 09:00 until 11:00\r\n" +
+	"\r\n" +
+	"\r\n"
+
+// canonicalize implements relaxed canonicalization independent of the signer.
+func canonicalize(s string) string {
+	s = regexp.MustCompile(`[ \t]+`).ReplaceAllString(s, " ")
+	return strings.TrimSpace(s)
+}
+
+// verifyDKIM verifies the first DKIM-Signature of the message with the public key.
+func verifyDKIM(msg string, public crypto.PublicKey) error {
+	header, body, _ := strings.Cut(msg, "\r\n\r\n")
+
+	var fields []string
+	for _, line := range strings.Split(header, "\r\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	signature, fields := fields[0], fields[1:]
+	if !strings.HasPrefix(signature, "DKIM-Signature:") {
+		return errors.New("no dkim signature")
+	}
+
+	tags := map[string]string{}
+	for _, tag := range strings.Split(strings.TrimPrefix(signature, "DKIM-Signature:"), ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(tag), "=")
+		tags[k] = v
+	}
+
+	var lines []string
+	for _, line := range strings.Split(body, "\r\n") {
+		lines = append(lines, strings.TrimRight(regexp.MustCompile(`[ \t]+`).ReplaceAllString(line, " "), " "))
+	}
+	canonicalBody := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n") + "\r\n"
+
+	bodyHash := sha256.Sum256([]byte(canonicalBody))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	var signed strings.Builder
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			k, v, _ := strings.Cut(fields[i], ":")
+			if used[i] || !strings.EqualFold(k, name) {
+				continue
+			}
+
+			used[i] = true
+			signed.WriteString(strings.ToLower(k) + ":" + canonicalize(strings.ReplaceAll(v, "\r\n", "")) + "\r\n")
+			break
+		}
+	}
+
+	unsigned := strings.TrimPrefix(signature[:strings.LastIndex(signature, "b=")+2], "DKIM-Signature:")
+	signed.WriteString("dkim-signature:" + canonicalize(unsigned))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(signed.String()))
+	switch public := public.(type) {
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" || !ed25519.Verify(public, hash[:], sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return errors.New("invalid algorithm")
+		}
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, hash[:], sig)
+	}
+
+	return errors.New("unsupported key")
+}
+
+func writeKey(t *testing.T, block *pem.Block) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+
+	return path
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		key    *pem.Block
+		public crypto.PublicKey
+	}{
+		{name: "rsa", key: &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, public: &rsaKey.PublicKey},
+		{name: "ed25519", key: &pem.Block{Type: "PRIVATE KEY", Bytes: edDER}, public: edPublic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := main.NewDKIMSigner("example.com", "barghman", writeKey(t, tt.key))
+			require.NoError(t, err)
+
+			signed, err := signer.Sign(dkimTestMessage)
+			require.NoError(t, err)
+			require.True(t, strings.HasSuffix(signed, dkimTestMessage))
+			require.Contains(t, signed, "c=relaxed/relaxed; d=example.com; s=barghman;")
+
+			require.NoError(t, verifyDKIM(signed, tt.public))
+
+			// Whitespace changes are allowed by relaxed canonicalization, content changes are not.
+			require.NoError(t, verifyDKIM(strings.Replace(signed, "Power  outage", "Power outage", 1), tt.public))
+			require.Error(t, verifyDKIM(strings.Replace(signed, "09:00", "10:00", 1), tt.public))
+			require.Error(t, verifyDKIM(strings.Replace(signed, "1404/06/01", "1404/06/02", 1), tt.public))
+		})
+	}
+}
+
+func TestDKIMInvalidKey(t *testing.T) {
+	_, err := main.NewDKIMSigner("example.com", "barghman", writeKey(t, &pem.Block{Type: "PRIVATE KEY", Bytes: []byte("invalid")}))
+	require.ErrorIs(t, err, main.ErrDKIMInvalidKey)
+}
@@ -1,22 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
-
-	ptime "github.com/yaa110/go-persian-calendar"
+	"unicode"
+	"unicode/utf8"
 )
 
 var ErrContentLengthMismatch = errors.New("content length mismatch")
 
+// clientsDirName is the directory of the caches of the clients under the cache directory.
+const clientsDirName = "clients"
+
 type FileContent struct {
-	UID                 string    `json:"uid" toml:"uid"`
-	BillID              string    `json:"bill_id" toml:"bill_id"`
+	UID    string `json:"uid" toml:"uid"`
+	BillID string `json:"bill_id" toml:"bill_id"`
+	// BillIDs are all the bills which the outage affects, it's empty if only BillID does.
+	BillIDs             []string  `json:"bill_ids,omitempty" toml:"bill_ids"`
 	Sequence            uint      `json:"sequence" toml:"sequence"`
 	OutageNumber        int       `json:"outage_number" toml:"outage_number"`
 	FarsiOutageDate     string    `json:"farsi_outage_date" toml:"farsi_outage_date"`
@@ -25,6 +34,65 @@ type FileContent struct {
 	Recipients          []string  `json:"recipients" toml:"recipients"`
 	Address             string    `json:"address" toml:"address"`
 	ReasonOutage        string    `json:"reason_outage" toml:"reason_outage"`
+	// OutageAddress is the area of the outage which the provider sends, it's often empty.
+	OutageAddress string `json:"outage_address,omitempty" toml:"outage_address"`
+	// Sources are the records of the provider which are merged into this outage, it's empty if it isn't merged.
+	Sources []OutageSource `json:"sources,omitempty" toml:"sources"`
+	// Delivered is the sequence of the event which each recipient received.
+	Delivered map[string]uint `json:"delivered,omitempty" toml:"delivered"`
+	// IsPlanned is true if the provider marks the outage as planned.
+	IsPlanned bool `json:"is_planned" toml:"is_planned"`
+	// Suppressed is why the filter of the client suppresses the outage, it's empty if the outage is sent.
+	Suppressed string `json:"suppressed,omitempty" toml:"suppressed"`
+}
+
+// Undelivered returns the recipients which didn't receive this sequence of the event.
+func (f *FileContent) Undelivered(recipients []string) []string {
+	var undelivered []string
+	for _, recipient := range recipients {
+		if sequence, ok := f.Delivered[recipient]; !ok || sequence != f.Sequence {
+			undelivered = append(undelivered, recipient)
+		}
+	}
+
+	return undelivered
+}
+
+// Removed returns the recipients which received the event, but aren't in the recipients anymore.
+func (f *FileContent) Removed(recipients []string) []string {
+	var removed []string
+	for recipient := range f.Delivered {
+		if !slices.Contains(recipients, recipient) {
+			removed = append(removed, recipient)
+		}
+	}
+
+	slices.Sort(removed)
+
+	return removed
+}
+
+// cancelSequence returns the sequence of the cancellation of the delivered recipients, it's only
+// bumped over the sequence which they received, so retrying the cancellation keeps it.
+func (f *FileContent) cancelSequence() uint {
+	for _, sequence := range f.Delivered {
+		if sequence >= f.Sequence {
+			return f.Sequence + 1
+		}
+	}
+
+	return f.Sequence
+}
+
+// MarkDelivered records that the recipients received this sequence of the event.
+func (f *FileContent) MarkDelivered(recipients []string) {
+	if f.Delivered == nil {
+		f.Delivered = make(map[string]uint, len(recipients))
+	}
+
+	for _, recipient := range recipients {
+		f.Delivered[recipient] = f.Sequence
+	}
 }
 
 // Pattern: "{bill_id}_{outage-number}_{outage-date}.json"
@@ -36,35 +104,265 @@ func FileName(billID string, outageNumber int, date time.Time) string {
 	return fmt.Sprintf("%s_%d_%s.json", billID, outageNumber, date.Format(time.DateOnly))
 }
 
-func (f *FileContent) Write(file *os.File) error {
+// safeFileName returns the name, e.g. of a client, as a part of a file name in the cache. The
+// characters other than the letters, the digits, "-" and "_" are replaced, and a fingerprint of the
+// name is added so the replaced names don't collide; the name can't escape the directory.
+func safeFileName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+
+		return '-'
+	}, name)
+
+	if safe == name && len(name) != 0 {
+		return name
+	}
+
+	return safe + "-" + fingerprint(name)
+}
+
+func (f *FileContent) Write(ctx context.Context, file *os.File) error {
 	content, err := json.Marshal(f)
 	if err != nil {
-		slog.Error("Encode data failed", "error", err)
+		slog.ErrorContext(ctx, "Encode data failed", "error", err)
+		return err
+	}
+
+	// Truncate the file first, the new content might be shorter than the old one.
+	if err := file.Truncate(0); err != nil {
+		slog.ErrorContext(ctx, "Failed to truncate file", "error", err)
 		return err
 	}
 
 	if _, err := file.WriteAt(content, 0); err != nil {
-		slog.Error("Failed to write content into file", "error", err)
+		slog.ErrorContext(ctx, "Failed to write content into file", "error", err)
 		return err
 	}
 
 	return nil
 }
 
-func LoadOrCreateFile(cachePathDir, billID string, outageNumber int, date time.Time) (*os.File, error) {
+// CacheDelivery records that the recipients received this sequence of the event in the cache file.
+// The cached content is kept if it has the same sequence, and it's never replaced by an older one.
+func (f *FileContent) CacheDelivery(ctx context.Context, cachePathDir string, recipients []string) error {
+	file, err := LoadOrCreateFile(ctx, cachePathDir, f.BillID, f.OutageNumber, f.StartOutageDateTime)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't load or create file", "error", err)
+		return err
+	}
+
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read cache file", "error", err)
+		return err
+	}
+
+	fc := f
+	if len(content) != 0 {
+		cached := new(FileContent)
+		if err := json.Unmarshal(content, cached); err != nil {
+			slog.ErrorContext(ctx, "decode the file data failed", "error", err)
+			return err
+		}
+
+		if cached.Sequence > f.Sequence {
+			slog.DebugContext(ctx, "cache has a newer sequence", "sequence", cached.Sequence)
+			return nil
+		}
+
+		if cached.Sequence == f.Sequence {
+			fc = cached
+		}
+	}
+
+	fc.MarkDelivered(recipients)
+
+	return fc.Write(ctx, file)
+}
+
+// CacheCancellation forgets the delivery of the event to the recipients in the cache file, once
+// its cancellation is sent to them. A cache file which is already removed is left alone.
+func (f *FileContent) CacheCancellation(ctx context.Context, cachePathDir string, recipients []string) error {
+	file, err := os.OpenFile(cachePathDir+f.FileName(), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't open file", "error", err)
+		return err
+	}
+
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil || len(content) == 0 {
+		return err
+	}
+
+	cached := new(FileContent)
+	if err := json.Unmarshal(content, cached); err != nil {
+		slog.ErrorContext(ctx, "decode the file data failed", "error", err)
+		return err
+	}
+
+	for _, recipient := range recipients {
+		delete(cached.Delivered, recipient)
+	}
+
+	return cached.Write(ctx, file)
+}
+
+// LoadCachedOutages returns all of the outages in the cache, sorted by their start time.
+func LoadCachedOutages(cachePathDir string) ([]*FileContent, error) {
+	files, err := os.ReadDir(cachePathDir)
+	if err != nil {
+		slog.Error("couldn't read all directories", "error", err)
+		return nil, err
+	}
+
+	var outages []*FileContent
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(cachePathDir, f.Name()))
+		if err != nil || len(content) == 0 {
+			continue
+		}
+
+		fc := new(FileContent)
+		if err := json.Unmarshal(content, fc); err != nil {
+			slog.Error("decode the file data failed", "error", err, "file name", SensitivePath(f.Name()))
+			continue
+		}
+
+		outages = append(outages, fc)
+	}
+
+	slices.SortFunc(outages, func(a, b *FileContent) int {
+		return a.StartOutageDateTime.Compare(b.StartOutageDateTime)
+	})
+
+	return outages, nil
+}
+
+// Status returns "suppressed" if the filter suppresses the outage, "sent" if all of its
+// recipients received its current version, or "pending" otherwise.
+func (f *FileContent) Status() string {
+	switch {
+	case len(f.Suppressed) != 0:
+		return "suppressed"
+
+	// The caches which are written before tracking the deliveries are sent to all of their recipients.
+	case f.Delivered == nil || len(f.Undelivered(f.Recipients)) == 0:
+		return "sent"
+
+	default:
+		return "pending"
+	}
+}
+
+func LoadOrCreateFile(ctx context.Context, cachePathDir, billID string, outageNumber int, date time.Time) (*os.File, error) {
 	filePath := cachePathDir + FileName(billID, outageNumber, date)
 
-	slog.Debug("file path to open or create", "file path", filePath)
+	// The cache directory of a client is created with its first outage.
+	if err := os.MkdirAll(cachePathDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	slog.DebugContext(ctx, "file path to open or create", "file path", SensitivePath(filePath))
 	return os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0o644)
 }
 
-func (f *FileContent) Summary() string {
-	return fmt.Sprintf("Power Outage on %s", f.Address)
+// ClientCachePath returns the directory of the cached outages of the client. Each client has its own
+// cache, so the clients which share a bill don't cancel the recipients of each other.
+func ClientCachePath(cachePathDir, client string) string {
+	return filepath.Join(cachePathDir, clientsDirName, safeFileName(client)) + "/"
 }
 
-func (f *FileContent) Description() string {
-	return strings.ReplaceAll(fmt.Sprintf("Blackout!\nAddress: %s\nDate: %s\nFrom %s until %s\nReason: %s",
-		f.Address, ptime.New(f.StartOutageDateTime).Format("yyyy/MM/dd"), f.StartOutageDateTime.Format(time.TimeOnly), f.EndOutageDateTime.Format(time.TimeOnly), f.ReasonOutage), "\n", "\\n")
+// MigrateCache copies the outages which are cached before the clients had their own caches into the
+// cache of each client of their bills, with only the deliveries to its recipients.
+func MigrateCache(cachePathDir string, clients map[string]Clients) error {
+	files, err := filepath.Glob(filepath.Join(cachePathDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	slog.Info("moving the cached outages into the caches of the clients", "files", len(files))
+
+	var errs []error
+	for _, path := range files {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		cached := new(FileContent)
+		if len(content) != 0 {
+			if err := json.Unmarshal(content, cached); err != nil {
+				slog.Error("decode the file data failed", "error", err, "file path", SensitivePath(path))
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		// The caches which are written before tracking the deliveries are sent to all of their recipients.
+		if cached.Delivered == nil && len(cached.Suppressed) == 0 {
+			cached.MarkDelivered(cached.Recipients)
+		}
+
+		for name, client := range clients {
+			bills := append(slices.Clone(client.BillIDs), client.BillID)
+			if !slices.ContainsFunc(cached.Bills(), func(billID string) bool { return slices.Contains(bills, billID) }) {
+				continue
+			}
+
+			fc := *cached
+			fc.Recipients, fc.Delivered = nil, make(map[string]uint)
+			for _, recipient := range client.Recipients {
+				if sequence, ok := cached.Delivered[recipient]; ok {
+					fc.Recipients = append(fc.Recipients, recipient)
+					fc.Delivered[recipient] = sequence
+				}
+			}
+
+			dir := ClientCachePath(cachePathDir, name)
+			if _, err := os.Stat(dir + fc.FileName()); err == nil {
+				continue
+			}
+
+			f, err := LoadOrCreateFile(context.Background(), dir, fc.BillID, fc.OutageNumber, fc.StartOutageDateTime)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			if err := fc.Write(context.Background(), f); err != nil {
+				errs = append(errs, err)
+			}
+
+			f.Close()
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func CreateCachePath() (string, error) {
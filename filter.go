@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidWeekday = errors.New("invalid weekday")
+
+// OutageFilter is the rules of the outages which are sent to the recipients of a client,
+// the other outages are suppressed. The empty rules keep all of the outages.
+type OutageFilter struct {
+	// IncludeReasons keeps only the outages which their reason contains one of them.
+	IncludeReasons []string `toml:"include_reasons"`
+	// ExcludeReasons suppresses the outages which their reason contains one of them.
+	ExcludeReasons []string `toml:"exclude_reasons"`
+	// PlannedOnly suppresses the outages which the provider doesn't mark as planned.
+	PlannedOnly bool `toml:"planned_only"`
+	// MinDuration suppresses the shorter outages, e.g. "30m".
+	MinDuration time.Duration `toml:"min_duration"`
+	// Weekdays keeps only the outages which start on one of them, e.g. ["saturday", "sun"].
+	Weekdays []Weekday `toml:"weekdays"`
+	// Hours keeps only the outages which overlap one of them, e.g. ["08:00-17:00"].
+	Hours []DailyRange `toml:"hours"`
+}
+
+// Weekday is a day of the week in the config, its English name or the first three letters of it.
+type Weekday time.Weekday
+
+func (w *Weekday) UnmarshalText(text []byte) error {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(string(text), d.String()) || strings.EqualFold(string(text), d.String()[:3]) {
+			*w = Weekday(d)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrInvalidWeekday, text)
+}
+
+func (w Weekday) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(time.Weekday(w).String())), nil
+}
+
+// Suppress returns why the outage is suppressed, or an empty string if it's sent.
+// The weekday and the hours are in the location.
+func (f OutageFilter) Suppress(fc *FileContent, loc *time.Location) string {
+	// The reasons are compared as the addresses, without the letter variants and the case.
+	reason := NormalizeAddress(fc.ReasonOutage)
+	contains := func(s string) bool { return strings.Contains(reason, NormalizeAddress(s)) }
+
+	if len(f.IncludeReasons) != 0 && !slices.ContainsFunc(f.IncludeReasons, contains) {
+		return "reason isn't included"
+	}
+
+	if i := slices.IndexFunc(f.ExcludeReasons, contains); i != -1 {
+		return fmt.Sprintf("reason %q is excluded", f.ExcludeReasons[i])
+	}
+
+	if f.PlannedOnly && !fc.IsPlanned {
+		return "not planned"
+	}
+
+	if duration := fc.EndOutageDateTime.Sub(fc.StartOutageDateTime); duration < f.MinDuration {
+		return fmt.Sprintf("shorter than %s", f.MinDuration)
+	}
+
+	start, end := fc.StartOutageDateTime.In(loc), fc.EndOutageDateTime.In(loc)
+
+	if len(f.Weekdays) != 0 && !slices.Contains(f.Weekdays, Weekday(start.Weekday())) {
+		return fmt.Sprintf("%s isn't included", strings.ToLower(start.Weekday().String()))
+	}
+
+	if len(f.Hours) != 0 && !slices.ContainsFunc(f.Hours, func(h DailyRange) bool { return h.Overlaps(start, end) }) {
+		return "outside of the hours"
+	}
+
+	return ""
+}
+
+// recordSuppressed keeps the suppressed outage of a digest in the cache, so the list command
+// shows it. The cache of an outage which isn't suppressed anymore is removed.
+func recordSuppressed(ctx context.Context, cachePathDir string, fc *FileContent, reason string) {
+	if len(reason) == 0 {
+		content, err := os.ReadFile(cachePathDir + fc.FileName())
+		if err != nil || len(content) == 0 {
+			return
+		}
+
+		cached := new(FileContent)
+		if err := json.Unmarshal(content, cached); err != nil || len(cached.Suppressed) == 0 {
+			return
+		}
+
+		if err := os.Remove(cachePathDir + fc.FileName()); err != nil {
+			slog.ErrorContext(ctx, "cannot remove the file", "error", err)
+		}
+		return
+	}
+
+	slog.InfoContext(ctx, "outage is suppressed by the filter", "reason", reason)
+
+	f, err := LoadOrCreateFile(ctx, cachePathDir, fc.BillID, fc.OutageNumber, fc.StartOutageDateTime)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't load or create file", "error", err)
+		return
+	}
+
+	defer f.Close()
+
+	suppressed := *fc
+	suppressed.Suppressed = reason
+	if err := suppressed.Write(ctx, f); err != nil {
+		slog.ErrorContext(ctx, "Failed to cache data", "error", err)
+	}
+}
+
+// suppress records the outage as suppressed in the cache, instead of sending it. It's cancelled
+// for the recipients which already received it, and its emails in the outbox are dropped.
+func suppress(ctx context.Context, mail Mail, outbox *Outbox, cachePathDir, clientName string, client Clients, fc *FileContent, reason string) {
+	slog.InfoContext(ctx, "outage is suppressed by the filter", "reason", reason)
+
+	f, err := LoadOrCreateFile(ctx, cachePathDir, fc.BillID, fc.OutageNumber, fc.StartOutageDateTime)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't load or create file", "error", err)
+		return
+	}
+
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read cache file", "error", err)
+		return
+	}
+
+	cached := new(FileContent)
+	if len(content) != 0 {
+		if err := json.Unmarshal(content, cached); err != nil {
+			slog.ErrorContext(ctx, "decode the file data failed", "error", err)
+			return
+		}
+
+		// The caches which are written before tracking the deliveries are sent to all of their recipients.
+		if cached.Delivered == nil && len(cached.Suppressed) == 0 {
+			cached.MarkDelivered(cached.Recipients)
+		}
+	}
+
+	fc.Sequence = cached.Sequence
+	fc.Delivered = cached.Delivered
+	fc.Suppressed = reason
+
+	for _, group := range client.RecipientGroups(client.Recipients) {
+		gfc := *fc
+		gfc.Recipients = group.Recipients
+
+		if err := outbox.Drop(ctx, OutboxID(clientName, &gfc)); err != nil && !errors.Is(err, ErrOutboxEntryNotFound) {
+			slog.ErrorContext(ctx, "Failed to drop outbox entry", "error", err)
+		}
+	}
+
+	if len(fc.Delivered) != 0 && fc.EndOutageDateTime.After(time.Now()) {
+		cancelDelivered(ctx, mail, outbox, clientName, client, fc)
+	}
+
+	if err := fc.Write(ctx, f); err != nil {
+		slog.ErrorContext(ctx, "Failed to cache data", "error", err)
+	}
+}
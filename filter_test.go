@@ -0,0 +1,304 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutageFilter(t *testing.T) {
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	var client main.Clients
+	_, err = toml.Decode(`
+[filter]
+exclude_reasons = ["مانور"]
+planned_only = true
+min_duration = "30m"
+weekdays = ["saturday", "Sun", "MONDAY", "tue", "wednesday"]
+hours = ["08:00-17:00"]
+`, &client)
+	require.NoError(t, err)
+
+	// 1404/06/01 is a Saturday.
+	outage := func(start, end string, modify func(*main.FileContent)) *main.FileContent {
+		fc, err := main.Data{
+			OutageDate:      "1404/06/01",
+			OutageStartTime: start,
+			OutageStopTime:  end,
+			ReasonOutage:    "مدیريت انرژی",
+			IsPlanned:       true,
+		}.ToFileContent(tehran, "123", nil, 0)
+		require.NoError(t, err)
+
+		if modify != nil {
+			modify(fc)
+		}
+
+		return fc
+	}
+
+	tests := []struct {
+		name   string
+		fc     *main.FileContent
+		reason string
+	}{
+		{name: "working hours", fc: outage("09:00", "11:00", nil)},
+		{name: "overlaps the start of working hours", fc: outage("07:00", "08:30", nil)},
+		{name: "exactly 30 minutes", fc: outage("16:30", "17:00", nil)},
+		{name: "after working hours", fc: outage("17:00", "19:00", nil), reason: "outside of the hours"},
+		{name: "too short", fc: outage("09:00", "09:20", nil), reason: "shorter than 30m0s"},
+		{name: "not planned", fc: outage("09:00", "11:00", func(fc *main.FileContent) { fc.IsPlanned = false }), reason: "not planned"},
+		{name: "excluded reason", fc: outage("09:00", "11:00", func(fc *main.FileContent) { fc.ReasonOutage = "مانور اضطراری" }), reason: `reason "مانور" is excluded`},
+		{
+			name: "weekend",
+			fc: outage("09:00", "11:00", func(fc *main.FileContent) {
+				fc.StartOutageDateTime, fc.EndOutageDateTime = fc.StartOutageDateTime.AddDate(0, 0, 6), fc.EndOutageDateTime.AddDate(0, 0, 6)
+			}),
+			reason: "friday isn't included",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.reason, client.Filter.Suppress(tt.fc, tehran))
+		})
+	}
+
+	// The reasons are compared without the letter variants, "ي" is "ی".
+	include := main.OutageFilter{IncludeReasons: []string{"مدیریت"}}
+	require.Empty(t, include.Suppress(outage("09:00", "11:00", nil), tehran))
+	require.Equal(t, "reason isn't included", include.Suppress(outage("09:00", "11:00", func(fc *main.FileContent) { fc.ReasonOutage = "تعمیرات" }), tehran))
+
+	require.Empty(t, main.OutageFilter{}.Suppress(outage("09:00", "09:10", func(fc *main.FileContent) { fc.IsPlanned = false }), tehran))
+
+	_, err = toml.Decode(`filter = { weekdays = ["someday"] }`, &client)
+	require.ErrorContains(t, err, main.ErrInvalidWeekday.Error())
+}
+
+func TestDailyRangeOverlaps(t *testing.T) {
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	at := func(day, hour int) time.Time { return time.Date(2025, time.August, day, hour, 0, 0, 0, tehran) }
+
+	night := main.DailyRange{Start: 22 * time.Hour, End: 6 * time.Hour}
+	require.True(t, night.Overlaps(at(23, 3), at(23, 5)))
+	require.True(t, night.Overlaps(at(23, 21), at(23, 23)))
+	require.False(t, night.Overlaps(at(23, 6), at(23, 22)))
+	require.True(t, night.Overlaps(at(23, 12), at(24, 12)))
+}
+
+func TestListCommand(t *testing.T) {
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	cachePathDir := t.TempDir() + "/"
+	start := time.Date(2025, time.August, 23, 9, 0, 0, 0, tehran)
+
+	for _, fc := range []*main.FileContent{
+		{BillID: "123", OutageNumber: 2, StartOutageDateTime: start.Add(4 * time.Hour), EndOutageDateTime: start.Add(5 * time.Hour), Suppressed: "outside of the hours"},
+		{BillID: "123", OutageNumber: 1, StartOutageDateTime: start, EndOutageDateTime: start.Add(2 * time.Hour), Recipients: []string{"a@example.com"}, Delivered: map[string]uint{"a@example.com": 0}},
+		{BillID: "456", OutageNumber: 3, StartOutageDateTime: start, EndOutageDateTime: start.Add(time.Hour), Recipients: []string{"a@example.com", "b@example.com"}, Delivered: map[string]uint{"b@example.com": 0}},
+	} {
+		f, err := main.LoadOrCreateFile(context.Background(), main.ClientCachePath(cachePathDir, "home"), fc.BillID, fc.OutageNumber, fc.StartOutageDateTime)
+		require.NoError(t, err)
+		require.NoError(t, fc.Write(context.Background(), f))
+		require.NoError(t, f.Close())
+	}
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	var b strings.Builder
+	require.NoError(t, main.RunCommand(&b, []string{"list"}, main.Config{Location: tehran}, cachePathDir, tehran, outbox))
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(t, lines, 4)
+	require.Regexp(t, `^CLIENT\s+BILL\s+OUTAGE\s+START\s+END\s+SEQUENCE\s+STATUS\s+REASON$`, lines[0])
+	require.Regexp(t, `^home\s+123\s+1\s+2025-08-23 09:00\s+11:00\s+0\s+sent\s*$`, lines[1])
+	require.Regexp(t, `^home\s+456\s+3\s+2025-08-23 09:00\s+10:00\s+0\s+pending\s*$`, lines[2])
+	require.Regexp(t, `^home\s+123\s+2\s+2025-08-23 13:00\s+14:00\s+0\s+suppressed\s+outside of the hours$`, lines[3])
+}
+
+func TestSuppressThenUnsuppress(t *testing.T) {
+	server := newFakeSMTPServer(t, nil, false)
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{
+		Name:           "local",
+		Mail:           "barghman@example.com",
+		Address:        "127.0.0.1",
+		Port:           server.port(),
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}, time.UTC, cachePathDir)
+
+	start := time.Now().UTC().Truncate(time.Hour).Add(48 * time.Hour)
+	outage := func() []*main.FileContent {
+		return []*main.FileContent{{
+			BillID:              "123",
+			OutageNumber:        1,
+			StartOutageDateTime: start,
+			EndOutageDateTime:   start.Add(time.Hour),
+			Recipients:          []string{"someone@example.com"},
+		}}
+	}
+
+	cached := func() *main.FileContent {
+		content, err := os.ReadFile(main.ClientCachePath(cachePathDir, "my_client") + main.FileName("123", 1, start))
+		require.NoError(t, err)
+
+		fc := new(main.FileContent)
+		require.NoError(t, json.Unmarshal(content, fc))
+
+		return fc
+	}
+
+	client := main.Clients{Recipients: []string{"someone@example.com"}, Locale: main.LocaleEnglish, Location: time.UTC}
+	suppressing := client
+	suppressing.Filter = main.OutageFilter{MinDuration: 2 * time.Hour}
+
+	// An outage which is suppressed before it's ever sent, is sent once it isn't suppressed anymore.
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", suppressing, outage())
+	require.Empty(t, server.Messages())
+	require.Equal(t, "shorter than 2h0m0s", cached().Suppressed)
+
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, outage())
+	require.Len(t, server.Messages(), 1)
+	require.Empty(t, cached().Suppressed)
+	require.Equal(t, map[string]uint{"someone@example.com": 1}, cached().Delivered)
+
+	// A sent outage is cancelled once it's suppressed, and sent again as an update after it.
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", suppressing, outage())
+	require.Len(t, server.Messages(), 2)
+	require.Contains(t, server.Messages()[1], "method=CANCEL")
+	require.Empty(t, cached().Delivered)
+
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, outage())
+	require.Len(t, server.Messages(), 3)
+	require.Contains(t, server.Messages()[2], "method=REQUEST")
+	require.Equal(t, map[string]uint{"someone@example.com": 3}, cached().Delivered)
+}
+
+func TestSuppressCancelRetried(t *testing.T) {
+	server := newFakeSMTPServer(t, nil, false)
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{
+		Name:           "local",
+		Mail:           "barghman@example.com",
+		Address:        "127.0.0.1",
+		Port:           server.port(),
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}, time.UTC, cachePathDir)
+
+	start := time.Now().UTC().Truncate(time.Hour).Add(48 * time.Hour)
+	outages := []*main.FileContent{{
+		BillID:              "123",
+		OutageNumber:        1,
+		StartOutageDateTime: start,
+		EndOutageDateTime:   start.Add(time.Hour),
+		Recipients:          []string{"someone@example.com"},
+	}}
+
+	cached := func() *main.FileContent {
+		content, err := os.ReadFile(main.ClientCachePath(cachePathDir, "my_client") + main.FileName("123", 1, start))
+		require.NoError(t, err)
+
+		fc := new(main.FileContent)
+		require.NoError(t, json.Unmarshal(content, fc))
+
+		return fc
+	}
+
+	client := main.Clients{Recipients: []string{"someone@example.com"}, Locale: main.LocaleEnglish, Location: time.UTC}
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages)
+	require.Len(t, server.Messages(), 1)
+
+	// The failed cancellation is retried with the same sequence.
+	server.mu.Lock()
+	server.reject = "someone@example.com"
+	server.mu.Unlock()
+
+	client.Filter = main.OutageFilter{MinDuration: 2 * time.Hour}
+	for range 2 {
+		main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages)
+		require.Equal(t, uint(0), cached().Sequence)
+		require.Equal(t, map[string]uint{"someone@example.com": 0}, cached().Delivered)
+	}
+
+	server.mu.Lock()
+	server.reject = ""
+	server.mu.Unlock()
+
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages)
+	require.Len(t, server.Messages(), 2)
+	require.Contains(t, server.Messages()[1], "method=CANCEL")
+	require.Equal(t, uint(1), cached().Sequence)
+	require.Empty(t, cached().Delivered)
+
+	// A deferred cancellation isn't sequenced again on the next runs.
+	client.Filter = main.OutageFilter{}
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages)
+	require.Equal(t, uint(2), cached().Sequence)
+
+	now := time.Now().UTC()
+	since := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	client.Filter = main.OutageFilter{MinDuration: 2 * time.Hour}
+	client.QuietHours = main.DailyRange{Start: (since + 23*time.Hour) % (24 * time.Hour), End: (since + 2*time.Hour) % (24 * time.Hour)}
+	for range 2 {
+		main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages)
+		require.Equal(t, uint(3), cached().Sequence)
+	}
+
+	require.Len(t, server.Messages(), 3)
+	entries, err := outbox.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestDeliverDigestSuppressed(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	start := time.Date(2025, time.August, 23, 9, 0, 0, 0, time.UTC)
+	outages := []*main.FileContent{
+		{BillID: "123", OutageNumber: 1, StartOutageDateTime: start, EndOutageDateTime: start.Add(time.Hour), ReasonOutage: "repair"},
+	}
+
+	// The outages which are left out of the digest are listed as suppressed.
+	client := main.Clients{Location: time.UTC, Filter: main.OutageFilter{ExcludeReasons: []string{"repair"}}}
+	mail := main.NewMailClient(main.SMTP{Mail: "barghman@example.com"}, time.UTC, cachePathDir)
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, start))
+
+	var b strings.Builder
+	require.NoError(t, main.RunCommand(&b, []string{"list"}, main.Config{Location: time.UTC}, cachePathDir, time.UTC, outbox))
+	require.Regexp(t, `my_client\s+123\s+1\s+2025-08-23 09:00\s+10:00\s+0\s+suppressed\s+reason "repair" is excluded`, b.String())
+
+	// The cache is removed once the outage isn't suppressed.
+	client.Filter = main.OutageFilter{}
+	require.NoError(t, main.DeliverDigest(context.Background(), mail, outbox, cachePathDir, "my_client", client, outages, start))
+	require.NoFileExists(t, main.ClientCachePath(cachePathDir, "my_client")+outages[0].FileName())
+}
@@ -4,8 +4,12 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"time"
 )
 
@@ -13,118 +17,507 @@ func DeleteCacheFunc(cachePathDir string, period time.Duration) func() {
 	return func() {
 		u := time.Now().Add(-period)
 
-		files, err := os.ReadDir(cachePathDir)
+		deleteCache(cachePathDir, u)
+
+		clients, err := os.ReadDir(filepath.Join(cachePathDir, clientsDirName))
 		if err != nil {
-			slog.Error("couldn't read all directories", "error", err)
+			if !errors.Is(err, os.ErrNotExist) {
+				slog.Error("couldn't read the caches of the clients", "error", err)
+			}
 			return
 		}
 
-		for _, f := range files {
-			info, err := f.Info()
-			if err != nil {
-				slog.Error("couldn't read info files", "error", err, "file name", f.Name())
-				continue
+		for _, client := range clients {
+			if client.IsDir() {
+				deleteCache(filepath.Join(cachePathDir, clientsDirName, client.Name()), u)
 			}
+		}
+	}
+}
+
+// deleteCache removes the files of the directory which are modified before u.
+func deleteCache(cachePathDir string, u time.Time) {
+	files, err := os.ReadDir(cachePathDir)
+	if err != nil {
+		slog.Error("couldn't read all directories", "error", err)
+		return
+	}
+
+	for _, f := range files {
+		// Directories like the outbox manage their own files.
+		if f.IsDir() {
+			continue
+		}
 
-			if info.ModTime().Before(u) {
-				filePath := cachePathDir + "/" + info.Name()
-				slog.Debug("removing cache", "file name", filePath)
+		info, err := f.Info()
+		if err != nil {
+			slog.Error("couldn't read info files", "error", err, "file name", SensitivePath(f.Name()))
+			continue
+		}
+
+		if info.ModTime().Before(u) {
+			filePath := cachePathDir + "/" + info.Name()
+			slog.Debug("removing cache", "file path", SensitivePath(filePath))
 
-				if err := os.Remove(filePath); err != nil {
-					slog.Error("cannot remove the file", "error", err, "file path", filePath)
-					continue
-				}
+			if err := os.Remove(filePath); err != nil {
+				slog.Error("cannot remove the file", "error", err, "file path", SensitivePath(filePath))
+				continue
 			}
 		}
 	}
 }
 
-func MailerFunc(cachePathDir string, config Config, location *time.Location) func() {
+// MailerFunc returns the job of the given clients, or of all the clients if no name is given.
+// The result of the run of each client is recorded in the state.
+func MailerFunc(cachePathDir string, config Config, location *time.Location, outbox *Outbox, state *StateStore, names ...string) func() {
 	return func() {
-		slog.Debug("job started")
+		ctx := WithLogAttrs(context.Background(), "run_id", newRunID())
+		slog.DebugContext(ctx, "job started", "clients", names)
+
+		pool := NewSMTPPool()
+		defer pool.Close()
 
 		for subject, c := range config.Clients {
+			if len(names) != 0 && !slices.Contains(names, subject) {
+				continue
+			}
+
+			ctx := WithLogAttrs(ctx, "client", subject)
+
+			state.RunStarted(subject, time.Now())
+			err := runClient(ctx, pool, cachePathDir, config, location, outbox, subject, c)
+			if err == nil {
+				lastSuccess.Set(float64(time.Now().Unix()), subject)
+			}
+
+			state.RunFinished(subject, time.Now(), err)
+		}
+
+		slog.DebugContext(ctx, "all clients sent, waiting for next cron cycle")
+	}
+}
+
+// runClient fetches the outages of the client and notifies its recipients. It fails if any of
+// the bills can't be fetched, the outages of the other bills are still sent.
+func runClient(ctx context.Context, pool *SMTPPool, cachePathDir string, config Config, location *time.Location, outbox *Outbox, subject string, c Clients) error {
+	smtp, ok := config.SMTP[c.SMTP]
+	if !ok {
+		slog.ErrorContext(ctx, "Cannot map between smtp config and client config", "smtp name", c.SMTP)
+		return fmt.Errorf("smtp config %q not found", c.SMTP)
+	}
+
+	// The outages are parsed in the timezone of the provider, and shown in the one of the client.
+	mail := NewMailClient(smtp, c.Location, cachePathDir)
+	mail.Pool = pool
+	mail.Templates = c.ParsedTemplates
+	mail.Individual = c.Mode == clientModeIndividual
+
+	if c.Mode == clientModeDigest {
+		return sendDigest(ctx, mail, outbox, cachePathDir, subject, c, location, config.MaxRangeDays, time.Second*time.Duration(config.WaitTime))
+	}
+
+	window := c.Window(time.Now())
+
+	var outages []*FileContent
+	var errs []error
+	for _, billID := range append(c.BillIDs, c.BillID) {
+		ctx := WithLogAttrs(ctx, "bill_id", Sensitive(billID))
 
-			smtp, ok := config.SMTP[c.SMTP]
-			if !ok {
-				slog.Error("Cannot map between smtp config and client config", "smtp name", c.SMTP)
+		data, err := PlannedBlackOutWindow(ctx, string(c.AuthToken), billID, window, location, config.MaxRangeDays)
+		if err != nil {
+			slog.ErrorContext(ctx, "PlannedBlackOut failed", "error", err)
+			if errors.Is(err, ErrAuthTokenExpired) {
+				tokenExpired.Inc(subject)
+			}
+
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, d := range data {
+			fc, err := d.ToFileContent(location, billID, c.Recipients, 0)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to convert data to file content", "error", err, "outage_number", d.OutageNumber)
 				continue
 			}
 
-			mail := NewMailClient(smtp, location)
+			if !window.Overlaps(fc.StartOutageDateTime, fc.EndOutageDateTime) {
+				continue
+			}
+
+			outagesFetched.Inc(subject)
+			outages = append(outages, fc)
+		}
+
+		time.Sleep(time.Second * time.Duration(config.WaitTime))
+	}
+
+	// Without all the bills, another bill of a group would send the outage again.
+	if len(errs) != 0 && c.Grouped() {
+		slog.ErrorContext(ctx, "Skipping the client, some of its grouped bills failed")
+		return errors.Join(errs...)
+	}
 
-			for _, billID := range append(c.BillIDs, c.BillID) {
-				data, err := PlannedBlackOut(context.Background(), c.AuthToken, billID, time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 5))
-				if err != nil {
-					slog.Error("PlannedBlackOut failed", "error", err)
-					continue
-				}
+	NotifyOutages(ctx, mail, outbox, cachePathDir, subject, c, outages)
 
-				for _, d := range data {
-					startDate, endDate, err := d.ParseTime(location)
-					if err != nil {
-						slog.Error("Failed to parse time", "error", err)
-						continue
-					}
+	return errors.Join(errs...)
+}
+
+// NotifyOutages merges and deduplicates the fetched outages of the client, and notifies the
+// recipients of each of them against its cached version in the cache of the client.
+func NotifyOutages(ctx context.Context, mail Mail, outbox *Outbox, cachePathDir, clientName string, client Clients, outages []*FileContent) {
+	cachePathDir = ClientCachePath(cachePathDir, clientName)
 
-					f, err := LoadOrCreateFile(cachePathDir, billID, d.OutageNumber, startDate)
-					if err != nil {
-						slog.Error("couldn't load or create file", "error", err)
-						continue
-					}
+	if client.MergeSlots {
+		outages = adoptOutages(ctx, mail, outbox, cachePathDir, clientName, client, MergeOutages(outages))
+	}
+
+	for _, fc := range client.Deduplicate(outages) {
+		if len(fc.BillIDs) > 1 {
+			supersedeDuplicates(ctx, mail, outbox, cachePathDir, clientName, client, fc)
+		}
+
+		ctx := withOutageLogAttrs(ctx, fc)
+
+		if reason := client.Filter.Suppress(fc, client.Location); len(reason) != 0 {
+			suppress(ctx, mail, outbox, cachePathDir, clientName, client, fc, reason)
+			continue
+		}
 
-					defer f.Close()
+		notify(ctx, mail, outbox, cachePathDir, clientName, client, fc)
+	}
+}
 
-					var fileData []byte
-					scanner := bufio.NewScanner(f)
-					for scanner.Scan() {
-						fileData = append(fileData, scanner.Bytes()...)
-					}
+// notify sends the outage to the recipients which didn't receive its current version, and
+// cancels it for the removed ones. The sequence and the deliveries are kept in the cache.
+func notify(ctx context.Context, mail Mail, outbox *Outbox, cachePathDir, clientName string, client Clients, fc *FileContent) {
+	f, err := LoadOrCreateFile(ctx, cachePathDir, fc.BillID, fc.OutageNumber, fc.StartOutageDateTime)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't load or create file", "error", err)
+		return
+	}
 
-					if err := scanner.Err(); err != nil {
-						slog.Error("scanner returns error", "error", err)
-						continue
-					}
+	defer f.Close()
 
-					fcf := new(FileContent)
-					var sequence uint
+	var fileData []byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fileData = append(fileData, scanner.Bytes()...)
+	}
 
-					if len(fileData) != 0 {
-						if err := json.Unmarshal(fileData, fcf); err != nil {
-							slog.Error("decode the file data failed", "error", err)
-							continue
-						}
+	if err := scanner.Err(); err != nil {
+		slog.ErrorContext(ctx, "scanner returns error", "error", err)
+		return
+	}
 
-						// Checks that the file loaded the start and end datetime is changed or not.
-						// If it doesn't changes, ignore it; If it changes, update it.
-						if fcf.StartOutageDateTime.Equal(startDate) || fcf.EndOutageDateTime.Equal(endDate) {
-							slog.Info("This data is already sent as email", "file name", fcf.FileName())
-							continue
-						}
+	cached := new(FileContent)
+	var unchanged bool
+	recipients := client.Recipients
 
-						sequence = fcf.Sequence + 1
-					}
+	if len(fileData) != 0 {
+		if err := json.Unmarshal(fileData, cached); err != nil {
+			slog.ErrorContext(ctx, "decode the file data failed", "error", err)
+			return
+		}
 
-					fcf, err = d.ToFileContent(location, billID, c.Recipients, sequence)
-					if err != nil {
-						slog.Error("Failed to convert data to file content", "error", err)
-						continue
-					}
+		// The caches which are written before tracking the deliveries are sent to all of their recipients,
+		// a suppressed outage is only delivered to the recipients in its Delivered.
+		if cached.Delivered == nil && len(cached.Suppressed) == 0 {
+			cached.MarkDelivered(cached.Recipients)
+		}
 
-					if err := mail.Do(fcf, subject); err != nil {
-						slog.Error("Failed to send mail", "error", err)
-						continue
-					}
+		fc.Sequence = cached.Sequence + 1
 
-					if err := fcf.Write(f); err != nil {
-						slog.Error("Failed to cache data", "error", err)
-					}
-				}
+		// Checks that the file loaded the start and end datetime is changed or not.
+		// If it doesn't changes, only the new recipients receive it; If it changes, update it.
+		// An outage which isn't suppressed anymore is sent as an update of its cancellation.
+		if len(cached.Suppressed) == 0 && cached.StartOutageDateTime.Equal(fc.StartOutageDateTime) && cached.EndOutageDateTime.Equal(fc.EndOutageDateTime) {
+			unchanged = true
+			fc.Sequence = cached.Sequence
+			recipients = nil
 
-				time.Sleep(time.Second * time.Duration(config.WaitTime))
+			if fc.EndOutageDateTime.After(time.Now()) {
+				recipients = cached.Undelivered(client.Recipients)
 			}
 		}
+	}
+
+	// The removed recipients of the upcoming outages receive a cancellation.
+	var removed []string
+	if fc.EndOutageDateTime.After(time.Now()) {
+		removed = cached.Removed(client.Recipients)
+	}
 
-		slog.Debug("all clients sent, waiting for next cron cycle")
+	if unchanged && len(recipients) == 0 && len(removed) == 0 {
+		slog.InfoContext(ctx, "This data is already sent as email")
+		return
 	}
+
+	switch {
+	case len(fileData) == 0:
+		outagesNew.Inc(clientName)
+	case !unchanged:
+		outagesUpdated.Inc(clientName)
+	}
+
+	fc.Delivered = cached.Delivered
+
+	deliver(ctx, mail, outbox, clientName, client, fc, recipients)
+	cancel(ctx, mail, outbox, clientName, client, fc, removed)
+
+	// The recipients which aren't delivered yet are retried on the next run.
+	if err := fc.Write(ctx, f); err != nil {
+		slog.ErrorContext(ctx, "Failed to cache data", "error", err)
+	}
+}
+
+// deliver sends the file content to each group of the recipients in its own locale, the failed
+// emails are queued in the outbox. The sent ones are marked as delivered.
+func deliver(ctx context.Context, mail Mail, outbox *Outbox, clientName string, client Clients, fc *FileContent, recipients []string) {
+	for _, group := range client.RecipientGroups(recipients) {
+		gfc := *fc
+		gfc.Recipients = group.Recipients
+
+		if outbox.Pending(clientName, &gfc) {
+			slog.InfoContext(ctx, "This data is already waiting in the outbox", "locale", group.Locale)
+			continue
+		}
+
+		msg, err := mail.Build(ctx, &gfc, clientName, group.Locale)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to build mail", "error", err)
+			continue
+		}
+
+		// The outages which don't start in the quiet hours are sent after them.
+		if until := client.quietUntil(time.Now(), &gfc); !until.IsZero() {
+			if err := outbox.Defer(ctx, clientName, client.SMTP, msg, &gfc, until); err != nil {
+				slog.ErrorContext(ctx, "Failed to defer mail in outbox", "error", err)
+			}
+			continue
+		}
+
+		if err := mail.Send(ctx, msg, gfc.Recipients); err != nil {
+			slog.ErrorContext(ctx, "Failed to send mail", "error", err)
+
+			if err := outbox.Enqueue(ctx, clientName, client.SMTP, msg, &gfc, err); err != nil {
+				slog.ErrorContext(ctx, "Failed to queue mail in outbox", "error", err)
+			}
+			continue
+		}
+
+		fc.MarkDelivered(group.Recipients)
+
+		// A newer version is sent, the older one shouldn't be retried.
+		if err := outbox.Drop(ctx, OutboxID(clientName, &gfc)); err != nil && !errors.Is(err, ErrOutboxEntryNotFound) {
+			slog.ErrorContext(ctx, "Failed to drop outbox entry", "error", err)
+		}
+	}
+}
+
+// cancel sends the cancellation of the file content to the removed recipients, and forgets
+// their delivery. The failed ones aren't queued, they're retried on the next run. The ones in
+// the quiet hours are deferred in the outbox, which forgets their delivery once it sends them.
+func cancel(ctx context.Context, mail Mail, outbox *Outbox, clientName string, client Clients, fc *FileContent, recipients []string) bool {
+	until := client.quietUntil(time.Now(), fc)
+
+	var cancelled, deferred bool
+	for _, group := range client.RecipientGroups(recipients) {
+		gfc := *fc
+		gfc.Recipients = group.Recipients
+
+		msg, err := mail.BuildCancel(ctx, &gfc, clientName, group.Locale)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to build cancellation mail", "error", err)
+			continue
+		}
+
+		if !until.IsZero() {
+			if err := outbox.DeferCancel(ctx, clientName, client.SMTP, msg, &gfc, until); err != nil {
+				slog.ErrorContext(ctx, "Failed to defer cancellation mail in outbox", "error", err)
+				continue
+			}
+
+			deferred = true
+			continue
+		}
+
+		if err := mail.Send(ctx, msg, gfc.Recipients); err != nil {
+			slog.ErrorContext(ctx, "Failed to send cancellation mail", "error", err, "recipients", SensitiveList(gfc.Recipients))
+			continue
+		}
+
+		for _, recipient := range group.Recipients {
+			delete(fc.Delivered, recipient)
+		}
+
+		cancelled = true
+
+		// The cancellation which is deferred on an earlier run shouldn't be sent again.
+		if err := outbox.Drop(ctx, outboxCancelID(clientName, &gfc)); err != nil && !errors.Is(err, ErrOutboxEntryNotFound) {
+			slog.ErrorContext(ctx, "Failed to drop outbox entry", "error", err)
+		}
+	}
+
+	if cancelled {
+		outagesCancelled.Inc(clientName)
+	}
+
+	return cancelled || deferred
+}
+
+// cancelDelivered cancels the file content for all of its delivered recipients. Its sequence is
+// bumped once for the cancellation, and only if the cancellation is sent or deferred.
+func cancelDelivered(ctx context.Context, mail Mail, outbox *Outbox, clientName string, client Clients, fc *FileContent) {
+	var recipients []string
+	for recipient := range fc.Delivered {
+		recipients = append(recipients, recipient)
+	}
+
+	slices.Sort(recipients)
+
+	sequence := fc.Sequence
+	fc.Sequence = fc.cancelSequence()
+	if !cancel(ctx, mail, outbox, clientName, client, fc, recipients) {
+		fc.Sequence = sequence
+	}
+}
+
+// sendDigest sends one email of all the upcoming outages of the client to each group of its recipients,
+// unless the outages and the recipients are the same as the last digest. It's retried on the next run if it fails.
+func sendDigest(ctx context.Context, mail Mail, outbox *Outbox, cachePathDir, clientName string, client Clients, location *time.Location, maxRangeDays int, waitTime time.Duration) error {
+	window := client.Window(time.Now())
+
+	var outages []*FileContent
+	for _, billID := range append(client.BillIDs, client.BillID) {
+		ctx := WithLogAttrs(ctx, "bill_id", Sensitive(billID))
+
+		data, err := PlannedBlackOutWindow(ctx, string(client.AuthToken), billID, window, location, maxRangeDays)
+		if err != nil {
+			// The outages of the bill would be missing from the digest, as if they're removed.
+			slog.ErrorContext(ctx, "PlannedBlackOut failed, skipping the digest", "error", err)
+			if errors.Is(err, ErrAuthTokenExpired) {
+				tokenExpired.Inc(clientName)
+			}
+
+			return err
+		}
+
+		for _, d := range data {
+			startDate, endDate, err := d.ParseTime(location)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to parse time", "error", err, "outage_number", d.OutageNumber)
+				continue
+			}
+
+			if !endDate.After(time.Now()) || !window.Overlaps(startDate, endDate) {
+				continue
+			}
+
+			fc, err := d.ToFileContent(location, billID, client.Recipients, 0)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to convert data to file content", "error", err)
+				continue
+			}
+
+			outagesFetched.Inc(clientName)
+			outages = append(outages, fc)
+		}
+
+		time.Sleep(waitTime)
+	}
+
+	if client.MergeSlots {
+		outages = MergeOutages(outages)
+	}
+
+	return DeliverDigest(ctx, mail, outbox, cachePathDir, clientName, client, client.Deduplicate(outages), time.Now())
+}
+
+// DeliverDigest sends the digest of the outages to each recipient group of the client, unless
+// the group already got the same digest. The suppressed outages and the ones which are ended by now
+// are left out, the suppressed ones are kept in the cache.
+func DeliverDigest(ctx context.Context, mail Mail, outbox *Outbox, cachePathDir, clientName string, client Clients, outages []*FileContent, now time.Time) error {
+	outages = slices.DeleteFunc(slices.Clone(outages), func(fc *FileContent) bool {
+		reason := client.Filter.Suppress(fc, client.Location)
+		recordSuppressed(withOutageLogAttrs(ctx, fc), ClientCachePath(cachePathDir, clientName), fc, reason)
+
+		return len(reason) != 0 || !fc.EndOutageDateTime.After(now)
+	})
+
+	state, err := LoadDigestState(ctx, cachePathDir, clientName)
+	if err != nil {
+		return err
+	}
+
+	fingerprint := DigestFingerprint(outages, client.Recipients)
+	if state.Unchanged(state.Fingerprint, outages, client.Recipients, now) || (len(outages) == 0 && state.Outages == 0) {
+		slog.InfoContext(ctx, "The digest isn't changed since the last one", "sent at", state.SentAt)
+		return nil
+	}
+
+	// The digest is deferred in the outbox until the quiet hours end, unless one of its outages starts in them.
+	until := client.quietHoursEnd(now)
+	if slices.ContainsFunc(outages, func(fc *FileContent) bool { return client.quietUntil(now, fc).IsZero() }) {
+		until = time.Time{}
+	}
+
+	if state.Groups == nil {
+		state.Groups = make(map[Locale]string)
+	}
+
+	var errs []error
+	for _, group := range client.RecipientGroups(client.Recipients) {
+		// The groups which got the digest before a failure of the others don't get it again.
+		groupFingerprint := DigestFingerprint(outages, group.Recipients)
+		if state.Unchanged(state.Groups[group.Locale], outages, group.Recipients, now) {
+			slog.DebugContext(ctx, "The recipients already got the digest", "locale", group.Locale)
+			continue
+		}
+
+		msg, err := mail.BuildDigest(ctx, outages, group.Recipients, clientName, group.Locale)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to build digest mail", "error", err)
+			errs = append(errs, err)
+			continue
+		}
+
+		// The outbox records the delivery of the group once it sends the digest.
+		if !until.IsZero() {
+			slog.InfoContext(ctx, "The digest is deferred until the quiet hours end", "locale", group.Locale)
+			if err := outbox.DeferDigest(ctx, clientName, client.SMTP, msg, group, groupFingerprint, until); err != nil {
+				slog.ErrorContext(ctx, "Failed to defer digest mail in outbox", "error", err)
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if err := mail.Send(ctx, msg, group.Recipients); err != nil {
+			slog.ErrorContext(ctx, "Failed to send digest mail", "error", err)
+			errs = append(errs, err)
+			continue
+		}
+
+		state.Groups[group.Locale] = groupFingerprint
+
+		// The digest which is deferred on an earlier run shouldn't be sent again.
+		if err := outbox.Drop(ctx, outboxDigestID(clientName, group.Locale)); err != nil && !errors.Is(err, ErrOutboxEntryNotFound) {
+			slog.ErrorContext(ctx, "Failed to drop outbox entry", "error", err)
+		}
+	}
+
+	// The deferred digest is recorded once the outbox sends it to all the groups.
+	if len(errs) == 0 && until.IsZero() {
+		state.Fingerprint, state.Outages, state.SentAt = fingerprint, len(outages), now
+	}
+
+	// The groups which got the digest compare the next one against its outages which aren't ended.
+	state.SetOutages(outages)
+
+	if err := state.Save(ctx, cachePathDir, clientName); err != nil {
+		slog.ErrorContext(ctx, "Failed to save digest state", "error", err)
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	ptime "github.com/yaa110/go-persian-calendar"
+)
+
+// Locale is the language of the user-facing output.
+type Locale string
+
+const (
+	LocaleEnglish Locale = "en"
+	LocalePersian Locale = "fa"
+)
+
+var localeValues = []Locale{LocaleEnglish, LocalePersian}
+
+var (
+	jalaliMonthsEnglish = [12]string{
+		"Farvardin", "Ordibehesht", "Khordad", "Tir", "Mordad", "Shahrivar",
+		"Mehr", "Aban", "Azar", "Dey", "Bahman", "Esfand",
+	}
+
+	jalaliWeekdaysEnglish = [7]string{
+		"Shanbeh", "Yekshanbeh", "Doshanbeh", "Seshanbeh", "Charshanbeh", "Panjshanbeh", "Jomeh",
+	}
+
+	persianDigits = strings.NewReplacer(
+		"0", "۰", "1", "۱", "2", "۲", "3", "۳", "4", "۴",
+		"5", "۵", "6", "۶", "7", "۷", "8", "۸", "9", "۹",
+	)
+
+	// asciiDigits replaces the Persian and Arabic digits with the ASCII ones.
+	asciiDigits = strings.NewReplacer(
+		"۰", "0", "۱", "1", "۲", "2", "۳", "3", "۴", "4", "۵", "5", "۶", "6", "۷", "7", "۸", "8", "۹", "9",
+		"٠", "0", "١", "1", "٢", "2", "٣", "3", "٤", "4", "٥", "5", "٦", "6", "٧", "7", "٨", "8", "٩", "9",
+	)
+)
+
+// Digits replaces the ASCII digits with the digits of the locale.
+func (l Locale) Digits(s string) string {
+	if l == LocalePersian {
+		return persianDigits.Replace(s)
+	}
+
+	return s
+}
+
+// JalaliMonth returns the name of the Jalali month, in Persian or transliterated.
+func (l Locale) JalaliMonth(m ptime.Month) string {
+	if l == LocalePersian {
+		return m.String()
+	}
+
+	return jalaliMonthsEnglish[min(max(int(m), 1), 12)-1]
+}
+
+// JalaliWeekday returns the name of the Jalali weekday, in Persian or transliterated.
+func (l Locale) JalaliWeekday(d ptime.Weekday) string {
+	if l == LocalePersian {
+		return d.String()
+	}
+
+	return jalaliWeekdaysEnglish[min(max(int(d), 0), 6)]
+}
+
+// Duration returns the duration in words, e.g. "2 hours 30 minutes" or "۲ ساعت و ۳۰ دقیقه".
+func (l Locale) Duration(d time.Duration) string {
+	hours, minutes := int(d.Hours()), int(d.Minutes())%60
+
+	if l == LocalePersian {
+		var parts []string
+		if hours > 0 {
+			parts = append(parts, l.Digits(strconv.Itoa(hours))+" ساعت")
+		}
+
+		if minutes > 0 || hours == 0 {
+			parts = append(parts, l.Digits(strconv.Itoa(minutes))+" دقیقه")
+		}
+
+		return strings.Join(parts, " و ")
+	}
+
+	var parts []string
+	switch {
+	case hours == 1:
+		parts = append(parts, "1 hour")
+	case hours > 1:
+		parts = append(parts, strconv.Itoa(hours)+" hours")
+	}
+
+	switch {
+	case minutes == 1:
+		parts = append(parts, "1 minute")
+	case minutes > 1 || hours == 0:
+		parts = append(parts, strconv.Itoa(minutes)+" minutes")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// RecipientGroup is the recipients which receive the email in the same locale.
+type RecipientGroup struct {
+	Locale     Locale
+	Recipients []string
+}
+
+// RecipientGroups groups the recipients of the client by their locale,
+// the recipients without a locale use the locale of the client.
+// In the individual mode, each recipient is a group on its own.
+func (c Clients) RecipientGroups(recipients []string) []RecipientGroup {
+	var groups []RecipientGroup
+	for _, recipient := range recipients {
+		locale, ok := c.RecipientLocales[recipient]
+		if !ok {
+			locale = c.Locale
+		}
+
+		i := 0
+		for i < len(groups) && groups[i].Locale != locale {
+			i++
+		}
+
+		if i == len(groups) || c.Mode == clientModeIndividual {
+			i = len(groups)
+			groups = append(groups, RecipientGroup{Locale: locale})
+		}
+
+		groups[i].Recipients = append(groups[i].Recipients, recipient)
+	}
+
+	return groups
+}
+
+// Locales returns all the locales which are used by the client.
+func (c Clients) Locales() []Locale {
+	locales := []Locale{c.Locale}
+	for _, locale := range c.RecipientLocales {
+		if !slices.Contains(locales, locale) {
+			locales = append(locales, locale)
+		}
+	}
+
+	return locales
+}
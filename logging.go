@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidLogLevel  = errors.New("invalid log level")
+	ErrInvalidLogFormat = errors.New("invalid log format")
+)
+
+type logFormat string
+
+const (
+	logFormatText logFormat = "text"
+	logFormatJSON logFormat = "json"
+)
+
+var logFormatValues = []logFormat{logFormatText, logFormatJSON}
+
+const (
+	// logOutputStderr and logOutputJournald are the outputs of the logs which aren't a file.
+	logOutputStderr   = "stderr"
+	logOutputJournald = "journald"
+
+	// journaldSocket is the socket of the native protocol of journald.
+	journaldSocket = "/run/systemd/journal/socket"
+
+	// DefaultLogMaxSize is the size of the log file in megabytes which it's rotated at.
+	DefaultLogMaxSize = 10
+	// DefaultLogMaxFiles is the number of the rotated log files which are kept.
+	DefaultLogMaxFiles = 5
+)
+
+// LogLevel is the verbosity of the logs, a name ("debug", "info", "warn" or "error", optionally
+// with an offset, e.g. "debug-4") or the number of the slog level, e.g. -4.
+type LogLevel slog.Level
+
+func (l *LogLevel) UnmarshalTOML(value any) error {
+	switch value := value.(type) {
+	case int64:
+		*l = LogLevel(value)
+	case string:
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidLogLevel, value)
+		}
+
+		*l = LogLevel(level)
+	default:
+		return fmt.Errorf("%w: %v", ErrInvalidLogLevel, value)
+	}
+
+	return nil
+}
+
+func (l LogLevel) String() string {
+	return slog.Level(l).String()
+}
+
+// NewLogger creates the logger of the config, the closer closes its output.
+func NewLogger(config Config) (*slog.Logger, io.Closer, error) {
+	options := &slog.HandlerOptions{Level: slog.Level(config.LogLevel)}
+
+	if config.LogOutput == logOutputJournald {
+		handler, err := newJournalHandler(options.Level)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return slog.New(&contextHandler{handler}), handler, nil
+	}
+
+	var w io.WriteCloser = nopCloser{os.Stderr}
+	if len(config.LogOutput) != 0 && config.LogOutput != logOutputStderr {
+		file, err := NewRotatingFile(config.LogOutput, int64(config.LogMaxSize)<<20, config.LogMaxFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		w = file
+	}
+
+	var handler slog.Handler = slog.NewTextHandler(w, options)
+	if config.LogFormat == logFormatJSON {
+		handler = slog.NewJSONHandler(w, options)
+	}
+
+	return slog.New(&contextHandler{handler}), w, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// logAttrsKey is the context key of the attributes which are added to each log of a job run.
+type logAttrsKey struct{}
+
+// WithLogAttrs returns a context whose logs have the attributes too, e.g. the client and the bill id.
+func WithLogAttrs(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	attrs = append(attrs[:len(attrs):len(attrs)], slog.Group("", args...).Value.Group()...)
+
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+// withOutageLogAttrs returns a context whose logs identify the outage.
+func withOutageLogAttrs(ctx context.Context, fc *FileContent) context.Context {
+	return WithLogAttrs(ctx, "bill_id", Sensitive(fc.BillID), "outage_number", fc.OutageNumber)
+}
+
+// newRunID identifies the logs of one run of a job.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// contextHandler adds the attributes of WithLogAttrs to the records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+// RotatingFile is a log file which is renamed to "<path>.1" once it reaches its maximum size,
+// the older ones are shifted to "<path>.2" and so on, and the ones after maxFiles are removed.
+// Zero maxSize means no limit.
+type RotatingFile struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	r := &RotatingFile{Path: path, MaxSize: maxSize, MaxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	// The logs might have personal data with log_sensitive, they're only readable by the service.
+	file, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file, r.size = file, info.Size()
+
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.MaxSize != 0 && r.size != 0 && r.size+int64(len(p)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", r.Path, r.MaxFiles))
+	for i := r.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+	}
+
+	if r.MaxFiles == 0 {
+		os.Remove(r.Path)
+	} else if err := os.Rename(r.Path, r.Path+".1"); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.file.Close()
+}
+
+// journalHandler sends the records to journald with its native protocol, the attributes
+// are sent as the fields of the entry, e.g. "client" as CLIENT and "outage.bill_id" as OUTAGE_BILL_ID.
+type journalHandler struct {
+	conn   *net.UnixConn
+	level  slog.Leveler
+	fields []byte
+	prefix string
+}
+
+func newJournalHandler(level slog.Leveler) (*journalHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to journald: %w", err)
+	}
+
+	return &journalHandler{conn: conn, level: level}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", r.Message)
+	appendJournalField(&b, "PRIORITY", journalPriority(r.Level))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", appName)
+	b.Write(h.fields)
+
+	r.Attrs(func(a slog.Attr) bool {
+		appendJournalAttr(&b, h.prefix, a)
+		return true
+	})
+
+	_, err := h.conn.Write(b.Bytes())
+
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b bytes.Buffer
+	b.Write(h.fields)
+	for _, a := range attrs {
+		appendJournalAttr(&b, h.prefix, a)
+	}
+
+	return &journalHandler{conn: h.conn, level: h.level, fields: b.Bytes(), prefix: h.prefix}
+}
+
+func (h *journalHandler) WithGroup(name string) slog.Handler {
+	return &journalHandler{conn: h.conn, level: h.level, fields: h.fields, prefix: h.prefix + name + "_"}
+}
+
+func (h *journalHandler) Close() error {
+	return h.conn.Close()
+}
+
+// journalPriority is the syslog priority of the level.
+func journalPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	default:
+		return "7"
+	}
+}
+
+func appendJournalAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if len(a.Key) != 0 {
+			prefix += a.Key + "_"
+		}
+
+		for _, a := range a.Value.Group() {
+			appendJournalAttr(b, prefix, a)
+		}
+		return
+	}
+
+	value := a.Value.String()
+	if a.Value.Kind() == slog.KindTime {
+		value = a.Value.Time().Format(time.RFC3339Nano)
+	}
+
+	appendJournalField(b, journalFieldName(prefix+a.Key), value)
+}
+
+// appendJournalField appends the field in the native protocol, the values with a new line
+// are sent with their length instead.
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+
+	b.WriteString(name + "\n")
+	b.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(value))))
+	b.WriteString(value + "\n")
+}
+
+// journalFieldName converts the key to a field name of journald, which only has uppercase
+// letters, digits and underscores, and doesn't start with an underscore or a digit.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+
+	name = strings.TrimLeft(name, "_")
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		name = "F_" + name
+	}
+
+	return name
+}
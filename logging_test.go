@@ -0,0 +1,200 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigLogLevel(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    slog.Level
+		wantErr error
+	}{
+		{value: `"debug"`, want: slog.LevelDebug},
+		{value: `"WARN"`, want: slog.LevelWarn},
+		{value: `"debug-4"`, want: slog.LevelDebug - 4},
+		{value: `-8`, want: slog.Level(-8)},
+		{value: `"verbose"`, wantErr: main.ErrInvalidLogLevel},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		require.NoError(t, os.WriteFile(path, []byte("log_level = "+tt.value+"\n"), 0o600))
+
+		config, err := main.LoadConfig(path)
+		if tt.wantErr != nil {
+			require.ErrorContains(t, err, tt.wantErr.Error(), tt.value)
+			continue
+		}
+
+		require.NoError(t, err, tt.value)
+		require.Equal(t, tt.want, slog.Level(config.LogLevel), tt.value)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`log_format = "xml"`), 0o600))
+
+	_, err := main.LoadConfig(path)
+	require.ErrorIs(t, err, main.ErrInvalidLogFormat)
+}
+
+func TestLoggerContextAttrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "barghman.log")
+
+	logger, output, err := main.NewLogger(main.Config{LogLevel: main.LogLevel(slog.LevelDebug), LogFormat: "json", LogOutput: path})
+	require.NoError(t, err)
+
+	ctx := main.WithLogAttrs(context.Background(), "run_id", "0123456789abcdef", "client", "home")
+	logger.InfoContext(main.WithLogAttrs(ctx, "bill_id", main.Sensitive("1234567890"), "outage_number", 42), "outage sent")
+	logger.DebugContext(ctx, "job finished")
+	require.NoError(t, output.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+
+	var first, second map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+
+	require.Equal(t, "outage sent", first["msg"])
+	require.Equal(t, "0123456789abcdef", first["run_id"])
+	require.Equal(t, "home", first["client"])
+	require.Equal(t, "******7890", first["bill_id"])
+	require.Equal(t, float64(42), first["outage_number"])
+
+	// The attributes of the outage don't leak into the other logs of the run.
+	require.Equal(t, "0123456789abcdef", second["run_id"])
+	require.NotContains(t, second, "bill_id")
+}
+
+func TestMailLogContextAttrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "barghman.log")
+
+	logger, output, err := main.NewLogger(main.Config{LogLevel: main.LogLevel(slog.LevelDebug), LogFormat: "json", LogOutput: path})
+	require.NoError(t, err)
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	// Nothing listens on the port, the email fails.
+	mail := main.NewMailClient(main.SMTP{
+		Name:           "logging-test",
+		Address:        "127.0.0.1",
+		Port:           "1",
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}, time.UTC, t.TempDir())
+
+	ctx := main.WithLogAttrs(context.Background(), "run_id", "0123456789abcdef", "client", "home", "bill_id", main.Sensitive("1234567890"))
+	require.Error(t, mail.Send(ctx, "Subject: test\r\n\r\nhello\r\n", []string{"someone@example.com"}))
+	require.NoError(t, output.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.NotEmpty(t, lines)
+
+	for _, line := range lines {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+
+		require.Equal(t, "0123456789abcdef", entry["run_id"], line)
+		require.Equal(t, "home", entry["client"], line)
+		require.Equal(t, "******7890", entry["bill_id"], line)
+	}
+}
+
+func TestOAuth2LogContextAttrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "barghman.log")
+
+	logger, output, err := main.NewLogger(main.Config{LogLevel: main.LogLevel(slog.LevelDebug), LogFormat: "json", LogOutput: path})
+	require.NoError(t, err)
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	// The token endpoint rejects the client secret, the email fails on the authentication.
+	var calls atomic.Int32
+	endpoint := newTokenEndpoint(t, &calls)
+	server := newFakeSMTPServer(t, nil, false)
+
+	mail := main.NewMailClient(main.SMTP{
+		Name:              "logging-test",
+		Address:           "127.0.0.1",
+		Port:              server.port(),
+		AuthMethod:        "xoauth2",
+		TLSMode:           "none",
+		DialTimeout:       time.Second,
+		CommandTimeout:    time.Second,
+		OAuthTokenURL:     endpoint.URL,
+		OAuthClientSecret: "wrong",
+		OAuthRefreshToken: "refresh-token",
+	}, time.UTC, t.TempDir())
+
+	ctx := main.WithLogAttrs(context.Background(), "run_id", "0123456789abcdef", "client", "home")
+	require.ErrorIs(t, mail.Send(ctx, "Subject: test\r\n\r\nhello\r\n", []string{"someone@example.com"}), main.ErrOAuth2TokenRefresh)
+	require.NoError(t, output.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var refreshed bool
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+
+		require.Equal(t, "0123456789abcdef", entry["run_id"], line)
+		require.Equal(t, "home", entry["client"], line)
+		refreshed = refreshed || entry["msg"] == "token endpoint returned an error"
+	}
+
+	require.True(t, refreshed)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "barghman.log")
+
+	file, err := main.NewRotatingFile(path, 100, 2)
+	require.NoError(t, err)
+
+	for i := range 10 {
+		_, err := fmt.Fprintf(file, "%02d %s\n", i, strings.Repeat("x", 46))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, file.Close())
+
+	for name, want := range map[string]string{"": "08", ".1": "06", ".2": "04"} {
+		content, err := os.ReadFile(path + name)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(string(content), want), name)
+		require.LessOrEqual(t, len(content), 100, name)
+	}
+
+	_, err = os.Stat(path + ".3")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
@@ -1,46 +1,28 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
-	"net"
+	"net/mail"
 	"net/smtp"
 	"strings"
 	"time"
 )
 
 var (
-	MailHeadersFormat = "From: %s <%s>\r\n" + // Name and Email
-		"To: %s\r\n" + // To.
-		"Bcc: %s\r\n" + // Bcc.
-		"Subject: Scheduled Power Outage on %s - %s\r\n" + // Subject.
-		"MIME-Version: 1.0\r\n" + // MIME-Version.
-		"Content-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n" // Boundary.
-
-	CalendarHeaderContent = "--%s\r\n" +
-		"Content-Type: text/calendar; method=REQUEST; charset=\"UTF-8\"\r\n" +
-		"Content-Transfer-Encoding: 7bit\r\n" +
-		"Content-Disposition: inline; filename=\"invite.ics\"\r\n\r\n" +
-		"BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Blu//Barghman Calendar//EN\r\nCALSCALE:GREGORIAN\r\nMETHOD:REQUEST\r\n"
-
-		/*
-			textContent = "--%s\r\n" + // boundary
-				"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
-				"Content-Transfer-Encoding: 7bit\r\n\r\n" +
-				"This is a test email for barghman service\r\n\r\n"
-		*/
-
-	CalendarFooterContent = "STATUS:CONFIRMED\r\nTRANSP:OPAQUE\r\nPRIORITY:5\r\nEND:VEVENT\r\n\r\n"
-
-	CalendarEndContent = "END:VCALENDAR\r\n--%s--\r\n"
+	CalendarHeaderFormat = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Blu//Barghman Calendar//EN\r\nCALSCALE:GREGORIAN\r\nMETHOD:%s\r\n"
+
+	CalendarFooterFormat = "STATUS:%s\r\nTRANSP:OPAQUE\r\nPRIORITY:5\r\nEND:VEVENT\r\n"
+
+	CalendarEndContent = "END:VCALENDAR\r\n"
 
 	CalendarBodyFormat = "BEGIN:VEVENT\r\n" +
 		"UID:%s\r\n" + // Unique ID.
 		"DTSTAMP:%s\r\n" + // When Event created.
-		"DTSTART:%s\r\n" + // Start time.
-		"DTEND:%s\r\n" + // End time.
+		"DTSTART;TZID=%s:%s\r\n" + // Start time, in the timezone of the client.
+		"DTEND;TZID=%s:%s\r\n" + // End time.
 		"SUMMARY:%s\r\n" + // Summary.
 		"DESCRIPTION:%s\r\n" + // Event details.
 		"LOCATION:%s\r\n" + // Location.
@@ -50,146 +32,356 @@ var (
 	CalendarAttendanceFormat = "ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:%s\r\n"
 
 	emailTimeFormat = "20060102T150405Z"
+
+	utf8Charset = map[string]string{"charset": "UTF-8"}
+)
+
+const (
+	// CalendarMethodRequest invites the attendees to the event, or updates it.
+	CalendarMethodRequest = "REQUEST"
+	// CalendarMethodCancel removes the event from the calendar of the attendees.
+	CalendarMethodCancel = "CANCEL"
+	// CalendarMethodPublish shares the events without inviting anyone, e.g. in the digest.
+	CalendarMethodPublish = "PUBLISH"
 )
 
 type Mail struct {
 	Auth   smtp.Auth
 	Config SMTP
-	Loc    *time.Location
+	// Loc is the timezone of the client, the emails and the events are shown in it.
+	Loc *time.Location
+	// Pool is optional, it reuses the smtp connection between messages of a job run.
+	Pool *SMTPPool
+	// Templates are optional, the built-in templates are used for the missing locales.
+	Templates map[Locale]*Templates
+	// Individual addresses the email to its recipients, instead of hiding them from each other.
+	Individual bool
 }
 
-func NewMailClient(config SMTP, loc *time.Location) Mail {
+// NewMailClient creates the mail client of the smtp config, cachePathDir is
+// where the state of the authentication (e.g. oauth2 tokens) is stored.
+func NewMailClient(config SMTP, loc *time.Location, cachePathDir string) Mail {
 	var auth smtp.Auth
 	switch config.AuthMethod {
 	case smtpAuthMethodMD5:
-		auth = smtp.CRAMMD5Auth(config.Username, config.Password)
+		auth = smtp.CRAMMD5Auth(config.Username, string(config.Password))
 
 	case smtpAuthMethodPlain:
-		auth = smtp.PlainAuth(config.Identity, config.Username, config.Password, config.Address)
+		auth = smtp.PlainAuth(config.Identity, config.Username, string(config.Password), config.Address)
 
 	case smtpAuthMethodCustom:
-		auth = LoginAuth(config.Username, config.Password)
+		auth = LoginAuth(config.Username, string(config.Password))
+
+	case smtpAuthMethodXOAuth2:
+		auth = XOAuth2Auth(config.Username, NewOAuth2TokenSource(config, cachePathDir))
 
+	case smtpAuthMethodNone:
+		auth = nil
 	}
 
 	return Mail{Auth: auth, Config: config, Loc: loc}
 }
 
-func (m Mail) Do(fc *FileContent, subject string) error {
-	boundary := generateBoundary()
+func (m Mail) Do(ctx context.Context, fc *FileContent, client string, locale Locale) error {
+	msg, err := m.Build(ctx, fc, client, locale)
+	if err != nil {
+		return err
+	}
+
+	return m.Send(ctx, msg, fc.Recipients)
+}
+
+// Build generates the email message of the file content, the structure is:
+//
+//	multipart/mixed
+//	├── multipart/alternative
+//	│   ├── text/plain
+//	│   ├── text/html
+//	│   └── text/calendar; method=REQUEST (shown as RSVP by Gmail and Outlook)
+//	└── application/ics attachment, for mail clients without calendar support
+func (m Mail) Build(ctx context.Context, fc *FileContent, client string, locale Locale) (string, error) {
+	return m.build(ctx, fc, client, locale, CalendarMethodRequest)
+}
+
+// BuildCancel generates the email which cancels the event for the recipients of the file content,
+// it has the same structure as Build.
+func (m Mail) BuildCancel(ctx context.Context, fc *FileContent, client string, locale Locale) (string, error) {
+	return m.build(ctx, fc, client, locale, CalendarMethodCancel)
+}
+
+func (m Mail) build(ctx context.Context, fc *FileContent, client string, locale Locale, method string) (string, error) {
+	rendered, err := m.templates(locale).Render(TemplateData{
+		FileContent: fc,
+		Client:      client,
+		Location:    m.Loc,
+		Locale:      locale,
+		Cancelled:   method == CalendarMethodCancel,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render templates", "error", err)
+		return "", err
+	}
+
+	calendar, err := m.Calendar(fc, rendered, method)
+	if err != nil {
+		return "", err
+	}
+
+	return m.message(ctx, fc.Recipients, rendered.Subject, &Part{
+		ContentType: "multipart/mixed",
+		Parts: []*Part{
+			{
+				ContentType: "multipart/alternative",
+				// The calendar part should be the last alternative, without a file name,
+				// otherwise Gmail and Outlook don't show their RSVP widget.
+				Parts: []*Part{
+					{ContentType: "text/plain", Params: utf8Charset, Encoding: EncodingQuotedPrintable, Body: []byte(rendered.Text)},
+					{ContentType: "text/html", Params: utf8Charset, Encoding: EncodingQuotedPrintable, Body: []byte(rendered.HTML)},
+					{ContentType: "text/calendar", Params: map[string]string{"method": method, "charset": "UTF-8"}, Encoding: EncodingBase64, Body: []byte(calendar)},
+				},
+			},
+			{ContentType: "application/ics", Disposition: "attachment", Filename: "invite.ics", Encoding: EncodingBase64, Body: []byte(calendar)},
+		},
+	})
+}
+
+// BuildDigest generates the digest email of the outages, the structure is:
+//
+//	multipart/mixed
+//	├── multipart/alternative
+//	│   ├── text/plain
+//	│   └── text/html
+//	└── application/ics attachment, with an event for each outage
+func (m Mail) BuildDigest(ctx context.Context, outages []*FileContent, recipients []string, client string, locale Locale) (string, error) {
+	templates := m.templates(locale)
+
+	rendered, err := templates.RenderDigest(NewDigestData(outages, client, m.Loc, locale))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render digest templates", "error", err)
+		return "", err
+	}
 
 	var content strings.Builder
-	if _, err := content.WriteString(fmt.Sprintf(MailHeadersFormat,
-		m.Config.From,
-		m.Config.Mail,
-		m.Config.Mail,
-		strings.Join(fc.Recipients, ","),
-		subject,
-		fc.FarsiOutageDate,
-		boundary,
-	)); err != nil {
-		slog.Error("Failed to write string", "error", err)
-		return err
+	content.WriteString(fmt.Sprintf(CalendarHeaderFormat, CalendarMethodPublish))
+
+	if len(outages) != 0 {
+		from, to := outages[0].StartOutageDateTime, outages[0].EndOutageDateTime
+		for _, fc := range outages {
+			if fc.StartOutageDateTime.Before(from) {
+				from = fc.StartOutageDateTime
+			}
+
+			if fc.EndOutageDateTime.After(to) {
+				to = fc.EndOutageDateTime
+			}
+		}
+
+		content.WriteString(VTimezone(m.Loc, from, to))
 	}
 
-	/*
-		if _, err := content.WriteString(fmt.Sprintf(textContent, boundary)); err != nil {
-			slog.Error("Failed to write text content", "error", err)
-			return err
+	for _, fc := range outages {
+		event, err := templates.Render(TemplateData{FileContent: fc, Client: client, Location: m.Loc, Locale: locale})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to render templates", "error", err)
+			return "", err
 		}
-	*/
 
-	if _, err := content.WriteString(fmt.Sprintf(CalendarHeaderContent, boundary)); err != nil {
-		slog.Error("Failed to write calendar header content", "error", err)
-		return err
+		m.writeEvent(&content, fc, event, CalendarMethodPublish)
+	}
+
+	content.WriteString(CalendarEndContent)
+
+	return m.message(ctx, recipients, rendered.Subject, &Part{
+		ContentType: "multipart/mixed",
+		Parts: []*Part{
+			{
+				ContentType: "multipart/alternative",
+				Parts: []*Part{
+					{ContentType: "text/plain", Params: utf8Charset, Encoding: EncodingQuotedPrintable, Body: []byte(rendered.Text)},
+					{ContentType: "text/html", Params: utf8Charset, Encoding: EncodingQuotedPrintable, Body: []byte(rendered.HTML)},
+				},
+			},
+			{ContentType: "application/ics", Disposition: "attachment", Filename: "outages.ics", Encoding: EncodingBase64, Body: []byte(foldCalendarLines(content.String()))},
+		},
+	})
+}
+
+// templates returns the templates of the locale, the built-in ones are used if the client doesn't have them.
+func (m Mail) templates(locale Locale) *Templates {
+	templates, ok := m.Templates[locale]
+	if !ok {
+		templates, ok = defaultTemplates[locale]
 	}
 
-	if _, err := content.WriteString(fmt.Sprintf(CalendarBodyFormat,
+	if !ok {
+		templates = defaultTemplates[LocaleEnglish]
+	}
+
+	return templates
+}
+
+// message generates the message of the body and signs it.
+func (m Mail) message(ctx context.Context, recipients []string, subject string, body *Part) (string, error) {
+	addresses, err := ParseAddresses(recipients)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to parse recipients", "error", err)
+		return "", err
+	}
+
+	from := &mail.Address{Name: m.Config.From, Address: m.Config.Mail}
+
+	// The recipients are hidden from each other, the email is addressed to the sender.
+	to, bcc := []*mail.Address{{Address: m.Config.Mail}}, addresses
+	if m.Individual {
+		to, bcc = addresses, nil
+	}
+
+	msg := &Message{
+		From:    from,
+		To:      to,
+		Bcc:     bcc,
+		Subject: subject,
+		Body:    body,
+	}
+
+	cont, err := msg.String()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to build message", "error", err)
+		return "", err
+	}
+
+	if m.Config.DKIMSigner != nil {
+		signed, err := m.Config.DKIMSigner.Sign(cont)
+		if err != nil {
+			slog.ErrorContext(ctx, "dkim signing failed", "error", err)
+			return "", err
+		}
+
+		cont = signed
+	}
+
+	slog.DebugContext(ctx, "content generated", "content", LogBody(cont))
+
+	return cont, nil
+}
+
+// Calendar generates the iCalendar invite of the file content.
+func (m Mail) Calendar(fc *FileContent, rendered *RenderedEmail, method string) (string, error) {
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf(CalendarHeaderFormat, method))
+	content.WriteString(VTimezone(m.Loc, fc.StartOutageDateTime, fc.EndOutageDateTime))
+	m.writeEvent(&content, fc, rendered, method)
+	content.WriteString(CalendarEndContent)
+
+	return foldCalendarLines(content.String()), nil
+}
+
+// writeEvent writes the VEVENT of the file content, the published events have no attendees.
+func (m Mail) writeEvent(content *strings.Builder, fc *FileContent, rendered *RenderedEmail, method string) {
+	content.WriteString(fmt.Sprintf(CalendarBodyFormat,
 		fmt.Sprintf("%d", fc.OutageNumber),
 		time.Now().UTC().Format(emailTimeFormat),
-		fc.StartOutageDateTime.UTC().Format(emailTimeFormat),
-		fc.EndOutageDateTime.UTC().Format(emailTimeFormat),
-		fc.Summary(),
-		fc.Description(),
-		fc.Address,
+		m.Loc.String(), fc.StartOutageDateTime.In(m.Loc).Format(calendarLocalTimeFormat),
+		m.Loc.String(), fc.EndOutageDateTime.In(m.Loc).Format(calendarLocalTimeFormat),
+		escapeCalendarText(rendered.Summary),
+		escapeCalendarText(rendered.Description),
+		escapeCalendarText(fc.Address),
 		fc.Sequence,
 		m.Config.Mail,
-	)); err != nil {
-		slog.Error("Failed to write event body", "error", err)
-		return err
-	}
+	))
 
-	for _, recipient := range fc.Recipients {
-		if _, err := content.WriteString(fmt.Sprintf(CalendarAttendanceFormat, recipient)); err != nil {
-			slog.Error("Failed to write recipient", "error", err)
-			return err
+	if method != CalendarMethodPublish {
+		for _, recipient := range fc.Recipients {
+			// The invalid addresses fail the build of the message, they're written as is here.
+			if a, err := mail.ParseAddress(recipient); err == nil {
+				recipient = a.Address
+			}
+
+			content.WriteString(fmt.Sprintf(CalendarAttendanceFormat, recipient))
 		}
 	}
 
-	if _, err := content.WriteString(CalendarFooterContent); err != nil {
-		slog.Error("Failed to write event-footer", "error", err)
-		return err
+	status := "CONFIRMED"
+	if method == CalendarMethodCancel {
+		status = "CANCELLED"
 	}
 
-	if _, err := content.WriteString(fmt.Sprintf(CalendarEndContent, boundary)); err != nil {
-		slog.Error("Failed to write calendar end content", "error", err)
+	content.WriteString(fmt.Sprintf(CalendarFooterFormat, status))
+}
+
+// Send sends the message, through the pool of the mail client if it has one;
+// otherwise it opens a new connection just for this message.
+func (m Mail) Send(ctx context.Context, msg string, recipients []string) error {
+	if err := m.send(ctx, msg, recipients); err != nil {
+		emailsFailed.Inc(m.Config.Name)
+		return err
 	}
 
-	cont := content.String()
-	slog.Debug("content generated", "content", cont)
+	emailsSent.Inc(m.Config.Name)
 
-	return m.Send(cont, fc.Recipients)
+	return nil
 }
 
-func (m Mail) Send(msg string, recipients []string) error {
-	conn, err := net.Dial("tcp", net.JoinHostPort(m.Config.Address, m.Config.Port))
+func (m Mail) send(ctx context.Context, msg string, recipients []string) error {
+	recipients, err := EnvelopeAddresses(recipients)
 	if err != nil {
-		slog.Error("can't dial the server", "error", err, "address", m.Config.Address)
+		slog.ErrorContext(ctx, "Failed to parse recipients", "error", err)
 		return err
 	}
 
-	client, err := smtp.NewClient(conn, m.Config.Address)
+	if m.Pool != nil {
+		return m.Pool.Send(ctx, m, msg, recipients)
+	}
+
+	client, err := m.dial(ctx)
 	if err != nil {
-		slog.Error("smtp new client failed", "error", err, "address", m.Config.Address)
 		return err
 	}
 
-	if err := client.StartTLS(&tls.Config{ServerName: m.Config.Address, InsecureSkipVerify: m.Config.SkipTLS}); err != nil {
-		slog.Error("can't start TLS", "error", err)
+	defer client.Close()
+
+	if err := m.transaction(ctx, client, msg, recipients); err != nil {
 		return err
 	}
 
-	if err := client.Auth(m.Auth); err != nil {
-		slog.Error("client auth failed", "error", err)
-		return err
+	if err := client.Quit(); err != nil {
+		slog.WarnContext(ctx, "client quit failed", "error", err)
 	}
 
+	return nil
+}
+
+// transaction sends a single message over an already authenticated client.
+func (m Mail) transaction(ctx context.Context, client *smtp.Client, msg string, recipients []string) error {
 	if err := client.Mail(m.Config.Mail); err != nil {
-		slog.Error("client mail failed", "error", err)
+		slog.ErrorContext(ctx, "client mail failed", "error", err)
 		return err
 	}
 
 	for _, rec := range recipients {
 		if err := client.Rcpt(rec); err != nil {
-			slog.Error("client rcpt failed", "error", err)
+			slog.ErrorContext(ctx, "client rcpt failed", "error", err)
 			return err
 		}
 	}
 
 	writer, err := client.Data()
 	if err != nil {
-		slog.Error("client data writer failed", "error", err)
+		slog.ErrorContext(ctx, "client data writer failed", "error", err)
 		return err
 	}
 
-	defer writer.Close()
-
 	if _, err := writer.Write([]byte(msg)); err != nil {
-		slog.Error("writer.Write failed", "error", err)
+		slog.ErrorContext(ctx, "writer.Write failed", "error", err)
+		return err
+	}
+
+	// Closing the writer finishes the DATA command, the message isn't accepted before it.
+	if err := writer.Close(); err != nil {
+		slog.ErrorContext(ctx, "client data close failed", "error", err)
 		return err
 	}
 
-	slog.Error("client quit error failed", "error", client.Quit())
 	return nil
 }
 
@@ -0,0 +1,491 @@
+package main_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer is a tiny smtp server which accepts every message.
+type fakeSMTPServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	implicit bool
+	// dropAfterData closes the connection after each accepted message.
+	dropAfterData bool
+	// reject is the recipient whose RCPT TO is rejected.
+	reject string
+
+	mu         sync.Mutex
+	messages   []string
+	recipients []string
+	conns      int
+}
+
+func newFakeSMTPServer(t *testing.T, tlsConfig *tls.Config, implicit bool) *fakeSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	if implicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	s := &fakeSMTPServer{listener: listener, tls: tlsConfig, implicit: implicit}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTPServer) port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+func (s *fakeSMTPServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.messages...)
+}
+
+// Recipients are the addresses of the RCPT TO commands.
+func (s *fakeSMTPServer) Recipients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.recipients...)
+}
+
+func (s *fakeSMTPServer) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conns
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	write := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	write("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			write("250-localhost")
+			if s.tls != nil && !s.implicit {
+				if _, ok := conn.(*tls.Conn); !ok {
+					write("250-STARTTLS")
+				}
+			}
+			write("250 AUTH PLAIN")
+
+		case cmd == "STARTTLS":
+			write("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+
+		case strings.HasPrefix(cmd, "AUTH"):
+			write("235 authenticated")
+
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			recipient := strings.TrimSpace(line)[len("RCPT TO:"):]
+
+			s.mu.Lock()
+			s.recipients = append(s.recipients, recipient)
+			reject := s.reject
+			s.mu.Unlock()
+
+			if recipient == "<"+reject+">" {
+				write("550 no such user")
+				continue
+			}
+
+			write("250 ok")
+
+		case cmd == "DATA":
+			write("354 go ahead")
+
+			var msg strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				if line == ".\r\n" {
+					break
+				}
+
+				msg.WriteString(line)
+			}
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg.String())
+			s.mu.Unlock()
+
+			write("250 queued")
+
+			if s.dropAfterData {
+				return
+			}
+
+		case cmd == "QUIT":
+			write("221 bye")
+			return
+
+		default:
+			write("250 ok")
+		}
+	}
+}
+
+// selfSignedCert creates a certificate for 127.0.0.1 and writes it into a CA file.
+func selfSignedCert(t *testing.T) (*tls.Config, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, caFile
+}
+
+func TestMailSendTLSModes(t *testing.T) {
+	serverTLS, caFile := selfSignedCert(t)
+
+	tests := []struct {
+		name     string
+		smtp     main.SMTP
+		tls      *tls.Config
+		implicit bool
+		wantErr  bool
+	}{
+		{name: "starttls", smtp: main.SMTP{TLSMode: "starttls"}, tls: serverTLS},
+		{name: "implicit", smtp: main.SMTP{TLSMode: "implicit"}, tls: serverTLS, implicit: true},
+		{name: "none", smtp: main.SMTP{TLSMode: "none"}},
+		{name: "opportunistic with tls", smtp: main.SMTP{TLSMode: "opportunistic"}, tls: serverTLS},
+		{name: "opportunistic without tls", smtp: main.SMTP{TLSMode: "opportunistic"}},
+		{name: "starttls without server support", smtp: main.SMTP{TLSMode: "starttls"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, tt.tls, tt.implicit)
+
+			smtp := tt.smtp
+			smtp.Mail = "barghman@example.com"
+			smtp.Address = "127.0.0.1"
+			smtp.Port = server.port()
+			smtp.Username = "barghman"
+			smtp.Password = "secret"
+			smtp.AuthMethod = "custom"
+			smtp.CAFile = caFile
+			smtp.DialTimeout = time.Second
+			smtp.CommandTimeout = time.Second
+
+			mail := main.NewMailClient(smtp, time.UTC, t.TempDir())
+
+			err := mail.Send(context.Background(), "Subject: test\r\n\r\nhello\r\n", []string{"someone@example.com", "Other <other@example.com>"})
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, server.Messages(), 1)
+			require.Contains(t, server.Messages()[0], "hello")
+			require.Equal(t, []string{"<someone@example.com>", "<other@example.com>"}, server.Recipients())
+		})
+	}
+}
+
+func TestSMTPPool(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int
+		dropAfterData bool
+		wantConns     int
+	}{
+		{name: "reuse connection", wantConns: 1},
+		{name: "messages per connection limit", limit: 2, wantConns: 3},
+		{name: "reconnect dropped connection", dropAfterData: true, wantConns: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, nil, false)
+			server.dropAfterData = tt.dropAfterData
+
+			mail := main.NewMailClient(main.SMTP{
+				Name:                     "local",
+				Mail:                     "barghman@example.com",
+				Address:                  "127.0.0.1",
+				Port:                     server.port(),
+				AuthMethod:               "none",
+				TLSMode:                  "none",
+				MaxMessagesPerConnection: tt.limit,
+				DialTimeout:              time.Second,
+				CommandTimeout:           time.Second,
+			}, time.UTC, t.TempDir())
+
+			mail.Pool = main.NewSMTPPool()
+			for range 5 {
+				require.NoError(t, mail.Send(context.Background(), "Subject: test\r\n\r\nhello\r\n", []string{"someone@example.com"}))
+			}
+			mail.Pool.Close()
+
+			require.Len(t, server.Messages(), 5)
+			require.Equal(t, tt.wantConns, server.Conns())
+		})
+	}
+}
+
+func TestMailBuild(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	fc, err := main.Data{
+		ReasonOutage:    "مدیریت انرژی",
+		OutageDate:      "1404/06/01",
+		OutageStartTime: "09:00",
+		OutageStopTime:  "11:30",
+		Address:         "HOME SWEET HOME",
+		OutageNumber:    218775,
+	}.ToFileContent(loc, "123", []string{"someone@example.com"}, 0)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{Mail: "barghman@example.com", From: "Barghman"}, loc, t.TempDir())
+	msg, err := mail.Build(context.Background(), fc, "my_client", main.LocaleEnglish)
+	require.NoError(t, err)
+
+	m, err := netmail.ReadMessage(strings.NewReader(msg))
+	require.NoError(t, err)
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	var types []string
+	var walk func(r *multipart.Reader)
+	walk = func(r *multipart.Reader) {
+		for {
+			part, err := r.NextPart()
+			if err == io.EOF {
+				return
+			}
+			require.NoError(t, err)
+
+			mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			require.NoError(t, err)
+			types = append(types, mediaType)
+
+			if strings.HasPrefix(mediaType, "multipart/") {
+				walk(multipart.NewReader(part, params["boundary"]))
+				continue
+			}
+
+			// NextPart decodes the quoted-printable parts itself.
+			var body io.Reader = part
+			if part.Header.Get("Content-Transfer-Encoding") == "base64" {
+				body = base64.NewDecoder(base64.StdEncoding, part)
+			}
+
+			content, err := io.ReadAll(body)
+			require.NoError(t, err)
+
+			switch mediaType {
+			case "text/plain", "text/html":
+				require.Contains(t, string(content), "HOME SWEET HOME")
+				require.Contains(t, string(content), "1404/06/01")
+				require.Contains(t, string(content), "Saturday, 23 August 2025")
+				require.Contains(t, string(content), "09:00 - 11:30 (2 hours 30 minutes)")
+				require.Contains(t, string(content), "مدیریت انرژی")
+
+			case "text/calendar", "application/ics":
+				require.Contains(t, string(content), "BEGIN:VCALENDAR")
+				require.Contains(t, string(content), "BEGIN:VTIMEZONE\r\nTZID:Asia/Tehran\r\n")
+				require.Contains(t, string(content), "DTSTART;TZID=Asia/Tehran:20250823T090000")
+			}
+		}
+	}
+	walk(multipart.NewReader(m.Body, params["boundary"]))
+
+	require.Equal(t, []string{"multipart/alternative", "text/plain", "text/html", "text/calendar", "application/ics"}, types)
+}
+
+func TestMailBuildHeaders(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	fc, err := main.Data{
+		OutageDate:      "1404/06/01",
+		OutageStartTime: "09:00",
+		OutageStopTime:  "11:30",
+		OutageNumber:    218775,
+	}.ToFileContent(loc, "123", []string{"someone@example.com", "Other <other@example.com>"}, 0)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{Mail: "barghman@example.com", From: "برق من"}, loc, t.TempDir())
+	msg, err := mail.Build(context.Background(), fc, "خانه", main.LocalePersian)
+	require.NoError(t, err)
+
+	header, _, _ := strings.Cut(msg, "\r\n\r\n")
+	for _, line := range strings.Split(header, "\r\n") {
+		require.LessOrEqual(t, len(line), 78, line)
+		require.Regexp(t, "^[\x20-\x7e\t]*$", line, "header isn't ascii")
+	}
+
+	// The recipients are only in the envelope.
+	require.NotContains(t, msg, "Bcc:")
+	require.NotContains(t, header, "someone@example.com")
+
+	m, err := netmail.ReadMessage(strings.NewReader(msg))
+	require.NoError(t, err)
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	require.NoError(t, err)
+	require.Contains(t, subject, "خانه")
+	require.Contains(t, subject, "۱۴۰۴/۰۶/۰۱")
+
+	from, err := m.Header.AddressList("From")
+	require.NoError(t, err)
+	require.Equal(t, []*netmail.Address{{Name: "برق من", Address: "barghman@example.com"}}, from)
+
+	_, err = m.Header.Date()
+	require.NoError(t, err)
+	require.Regexp(t, `^<[0-9a-f]+@example\.com>$`, m.Header.Get("Message-ID"))
+
+	// The attendees are the bare addresses, without the names.
+	calendar, err := mail.Calendar(fc, new(main.RenderedEmail), main.CalendarMethodRequest)
+	require.NoError(t, err)
+	calendar = strings.ReplaceAll(calendar, "\r\n ", "")
+	require.Contains(t, calendar, "RSVP=TRUE:mailto:someone@example.com\r\n")
+	require.Contains(t, calendar, "RSVP=TRUE:mailto:other@example.com\r\n")
+
+	_, err = mail.Build(context.Background(), &main.FileContent{Recipients: []string{"not an address"}}, "خانه", main.LocalePersian)
+	require.Error(t, err)
+}
+
+func TestMailBuildIndividual(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	fc, err := main.Data{
+		OutageDate:      "1404/06/01",
+		OutageStartTime: "09:00",
+		OutageStopTime:  "11:30",
+		OutageNumber:    218775,
+	}.ToFileContent(loc, "123", []string{"someone@example.com"}, 0)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{Mail: "barghman@example.com", From: "Barghman"}, loc, t.TempDir())
+	mail.Individual = true
+
+	msg, err := mail.Build(context.Background(), fc, "my_client", main.LocaleEnglish)
+	require.NoError(t, err)
+
+	m, err := netmail.ReadMessage(strings.NewReader(msg))
+	require.NoError(t, err)
+	require.Equal(t, "<someone@example.com>", m.Header.Get("To"))
+
+	calendar, err := mail.Calendar(fc, &main.RenderedEmail{}, main.CalendarMethodRequest)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(calendar, "ATTENDEE"))
+	require.Contains(t, strings.ReplaceAll(calendar, "\r\n ", ""), "mailto:someone@example.com")
+}
+
+func TestMailBuildCancel(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	fc, err := main.Data{
+		OutageDate:      "1404/06/01",
+		OutageStartTime: "09:00",
+		OutageStopTime:  "11:30",
+		OutageNumber:    218775,
+	}.ToFileContent(loc, "123", []string{"removed@example.com"}, 2)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{Mail: "barghman@example.com", From: "Barghman"}, loc, t.TempDir())
+	msg, err := mail.BuildCancel(context.Background(), fc, "my_client", main.LocaleEnglish)
+	require.NoError(t, err)
+
+	m, err := netmail.ReadMessage(strings.NewReader(msg))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(m.Header.Get("Subject"), "Cancelled: "))
+	require.Contains(t, msg, "text/calendar; charset=UTF-8; method=CANCEL")
+
+	calendar, err := mail.Calendar(fc, &main.RenderedEmail{}, main.CalendarMethodCancel)
+	require.NoError(t, err)
+	require.Contains(t, calendar, "METHOD:CANCEL\r\n")
+	require.Contains(t, calendar, "STATUS:CANCELLED\r\n")
+	require.Contains(t, calendar, "SEQUENCE:2\r\n")
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log/slog"
+	"net/http"
 	"os"
 	"time"
 
@@ -19,10 +22,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	slog.SetLogLoggerLevel(slog.Level(config.LogLevel))
+	logger, logOutput, err := NewLogger(*config)
+	if err != nil {
+		slog.Error("Failed to open log output", "error", err, "output", config.LogOutput)
+		os.Exit(1)
+	}
+
+	defer logOutput.Close()
+
+	slog.SetDefault(logger)
+	LogSensitive = config.LogSensitive
 	slog.Debug("config file loaded", "config", config)
 
-	location, err := time.LoadLocation("Asia/Tehran")
+	// location is the timezone of the provider, its outage times are in it.
+	location, err := time.LoadLocation(DefaultTimezone)
 	if err != nil {
 		slog.Error("Unable to load location", "error", err)
 		os.Exit(1)
@@ -34,19 +47,77 @@ func main() {
 		os.Exit(1)
 	}
 
-	jobFunc := MailerFunc(cachePathDir, *config, location)
+	// The outages which are cached before the clients had their own caches are moved into them.
+	if err := MigrateCache(cachePathDir, config.Clients); err != nil {
+		slog.Error("failed to move the cached outages into the caches of the clients", "error", err)
+	}
+
+	outbox, err := NewOutbox(cachePathDir, config.OutboxBaseBackoff, config.OutboxMaxBackoff)
+	if err != nil {
+		slog.Error("failed to create outbox", "error", err)
+		os.Exit(1)
+	}
+
+	if flag.NArg() != 0 {
+		if err := RunCommand(os.Stdout, flag.Args(), *config, cachePathDir, location, outbox); err != nil {
+			slog.Error("command failed", "command", flag.Arg(0), "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	state, err := NewStateStore(cachePathDir)
+	if err != nil {
+		slog.Error("failed to create state store", "error", err)
+		os.Exit(1)
+	}
+
 	deleteFunc := DeleteCacheFunc(cachePathDir, config.DeleteDurationPeriod)
+	outboxSender := OutboxSender(*config, location, cachePathDir, time.Now)
+
+	// The clients without their own cron job follow the global one.
+	var scheduled, shared []string
+	for name, client := range config.Clients {
+		if len(client.CronJob) != 0 {
+			scheduled = append(scheduled, name)
+			continue
+		}
 
-	if len(config.CronJob) == 0 {
-		jobFunc()
+		shared = append(shared, name)
+	}
+
+	if len(config.CronJob) == 0 && len(scheduled) == 0 {
+		if err := sdNotify("READY=1"); err != nil {
+			slog.Error("Failed to notify systemd", "error", err)
+		}
+
+		if err := outbox.Process(context.Background(), cachePathDir, false, outboxSender); err != nil {
+			slog.Error("some outbox entries failed again", "error", err)
+		}
+
+		MailerFunc(cachePathDir, *config, location, outbox, state)()
 		return
 	}
 
-	c := cron.New(cron.WithLocation(location))
+	c := cron.New(cron.WithLocation(config.Location))
 
-	if _, err := c.AddFunc(config.CronJob, jobFunc); err != nil {
-		slog.Error("couldn't add mailer func to the cron job", "error", err)
-		os.Exit(1)
+	for _, name := range scheduled {
+		if _, err := c.AddFunc(config.Clients[name].Schedule(), MailerFunc(cachePathDir, *config, location, outbox, state, name)); err != nil {
+			slog.Error("couldn't add mailer func of the client to the cron job", "error", err, "client", name)
+			os.Exit(1)
+		}
+	}
+
+	if len(shared) != 0 {
+		jobFunc := MailerFunc(cachePathDir, *config, location, outbox, state, shared...)
+
+		// Without the global cron job, the other clients run once as a one-time job.
+		if len(config.CronJob) == 0 {
+			go jobFunc()
+		} else if _, err := c.AddFunc(config.CronJob, jobFunc); err != nil {
+			slog.Error("couldn't add mailer func to the cron job", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	if _, err := c.AddFunc("@daily", deleteFunc); err != nil {
@@ -56,6 +127,32 @@ func main() {
 
 	defer c.Stop()
 	c.Start()
+	state.Started(time.Now())
+
+	status := func() Status {
+		return BuildStatus(*config, cachePathDir, outbox, state.State(), time.Now())
+	}
+
+	if len(config.ListenAddress) != 0 {
+		RegisterCacheMetrics(metrics, cachePathDir)
+
+		go func() {
+			if err := http.ListenAndServe(config.ListenAddress, NewServeMux(status)); err != nil {
+				slog.Error("http listener failed", "error", err, "address", config.ListenAddress)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	go outbox.Loop(context.Background(), cachePathDir, outboxSender)
+
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Error("Failed to notify systemd", "error", err)
+	}
+
+	if interval := watchdogInterval(); interval != 0 {
+		go Watchdog(context.Background(), interval, func() bool { return status().Healthy })
+	}
 
 	select {}
 }
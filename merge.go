@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OutageSource is a record of the provider which is merged into an outage.
+type OutageSource struct {
+	OutageNumber int       `json:"outage_number" toml:"outage_number"`
+	Start        time.Time `json:"start" toml:"start"`
+	End          time.Time `json:"end" toml:"end"`
+}
+
+// SourceRecords returns the records of the provider which the outage is made of.
+func (f *FileContent) SourceRecords() []OutageSource {
+	if len(f.Sources) != 0 {
+		return f.Sources
+	}
+
+	return []OutageSource{{OutageNumber: f.OutageNumber, Start: f.StartOutageDateTime, End: f.EndOutageDateTime}}
+}
+
+// HasSource reports whether the outage is made of the record of the outage number.
+func (f *FileContent) HasSource(outageNumber int) bool {
+	return slices.ContainsFunc(f.SourceRecords(), func(s OutageSource) bool { return s.OutageNumber == outageNumber })
+}
+
+// MergeOutages merges the contiguous and overlapping outages of the same bill into one outage,
+// which has the outage number of the earliest one and keeps all of them in its Sources.
+// The result is sorted by the bill and the start time.
+func MergeOutages(outages []*FileContent) []*FileContent {
+	sorted := slices.Clone(outages)
+	slices.SortStableFunc(sorted, func(a, b *FileContent) int {
+		if c := strings.Compare(a.BillID, b.BillID); c != 0 {
+			return c
+		}
+
+		return a.StartOutageDateTime.Compare(b.StartOutageDateTime)
+	})
+
+	var merged []*FileContent
+	for _, fc := range sorted {
+		if len(merged) != 0 {
+			last := merged[len(merged)-1]
+			if last.BillID == fc.BillID && !fc.StartOutageDateTime.After(last.EndOutageDateTime) {
+				last.Sources = append(last.SourceRecords(), fc.SourceRecords()...)
+				if fc.EndOutageDateTime.After(last.EndOutageDateTime) {
+					last.EndOutageDateTime = fc.EndOutageDateTime
+				}
+
+				last.Address = appendDistinct(last.Address, fc.Address)
+				last.OutageAddress = appendDistinct(last.OutageAddress, fc.OutageAddress)
+				last.ReasonOutage = appendDistinct(last.ReasonOutage, fc.ReasonOutage)
+				last.IsPlanned = last.IsPlanned && fc.IsPlanned
+				continue
+			}
+		}
+
+		c := *fc
+		merged = append(merged, &c)
+	}
+
+	return merged
+}
+
+// appendDistinct appends the value to the list which is joined by " / ", if it doesn't have it.
+// The values are compared normalized, e.g. "پلاک ۱۲" and "پلاك 12" are the same.
+func appendDistinct(list, value string) string {
+	if len(value) == 0 || slices.ContainsFunc(strings.Split(list, " / "), func(v string) bool {
+		return NormalizeAddress(v) == NormalizeAddress(value)
+	}) {
+		return list
+	}
+
+	if len(list) == 0 {
+		return value
+	}
+
+	return list + " / " + value
+}
+
+// cachedSources returns the cached outages of the same day which share a source record with the outage.
+func cachedSources(ctx context.Context, cachePathDir string, fc *FileContent) []*FileContent {
+	pattern := fmt.Sprintf("%s%s_*_%s.json", cachePathDir, fc.BillID, fc.StartOutageDateTime.Format(time.DateOnly))
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find cached outages", "error", err, "pattern", SensitivePath(pattern))
+		return nil
+	}
+
+	var cached []*FileContent
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil || len(content) == 0 {
+			continue
+		}
+
+		c := new(FileContent)
+		if err := json.Unmarshal(content, c); err != nil {
+			slog.ErrorContext(ctx, "decode the file data failed", "error", err, "file path", SensitivePath(path))
+			continue
+		}
+
+		if slices.ContainsFunc(fc.SourceRecords(), func(s OutageSource) bool { return c.HasSource(s.OutageNumber) }) {
+			cached = append(cached, c)
+		}
+	}
+
+	slices.SortFunc(cached, func(a, b *FileContent) int { return a.StartOutageDateTime.Compare(b.StartOutageDateTime) })
+
+	return cached
+}
+
+// adoptOutages keeps the identity of the merged outages across the runs: an outage takes the
+// outage number of its cached version, even if its first record is removed. The cached outages
+// which are merged into another one are cancelled.
+func adoptOutages(ctx context.Context, mail Mail, outbox *Outbox, cachePathDir, clientName string, client Clients, outages []*FileContent) []*FileContent {
+	owner := make(map[int]*FileContent)
+	for _, fc := range outages {
+		for _, source := range fc.SourceRecords() {
+			owner[source.OutageNumber] = fc
+		}
+	}
+
+	claimed := make(map[int]bool)
+	for _, fc := range outages {
+		cached := cachedSources(withOutageLogAttrs(ctx, fc), cachePathDir, fc)
+
+		// The cached version with one of the outage numbers of the outage is preferred, the
+		// others are adopted only if their outage number isn't used by another outage.
+		var primary *FileContent
+		for _, c := range cached {
+			if !claimed[c.OutageNumber] && owner[c.OutageNumber] == fc {
+				primary = c
+				break
+			}
+		}
+
+		if primary == nil {
+			for _, c := range cached {
+				if !claimed[c.OutageNumber] && owner[c.OutageNumber] == nil {
+					primary = c
+					break
+				}
+			}
+		}
+
+		if primary != nil && primary.OutageNumber != fc.OutageNumber {
+			slog.DebugContext(ctx, "outage adopts its cached version", "outage", primary, "outage number", fc.OutageNumber)
+
+			fc.OutageNumber = primary.OutageNumber
+			fc.UID = fmt.Sprintf("%s_%d_%s", fc.BillID, fc.OutageNumber, fc.StartOutageDateTime.Format(time.DateOnly))
+		}
+
+		claimed[fc.OutageNumber] = true
+
+		for _, c := range cached {
+			if claimed[c.OutageNumber] || (owner[c.OutageNumber] != nil && owner[c.OutageNumber] != fc) {
+				continue
+			}
+
+			supersede(ctx, mail, outbox, cachePathDir, clientName, client, c)
+		}
+	}
+
+	return outages
+}
+
+// supersede cancels the cached outage for all of its recipients, and removes it from the cache
+// once they're all cancelled.
+func supersede(ctx context.Context, mail Mail, outbox *Outbox, cachePathDir, clientName string, client Clients, fc *FileContent) {
+	ctx = withOutageLogAttrs(ctx, fc)
+	slog.InfoContext(ctx, "outage is merged into another one, cancelling it")
+
+	if fc.EndOutageDateTime.After(time.Now()) {
+		cancelDelivered(ctx, mail, outbox, clientName, client, fc)
+	}
+
+	f, err := LoadOrCreateFile(ctx, cachePathDir, fc.BillID, fc.OutageNumber, fc.StartOutageDateTime)
+	if err != nil {
+		slog.ErrorContext(ctx, "couldn't load or create file", "error", err)
+		return
+	}
+
+	defer f.Close()
+
+	if len(fc.Delivered) != 0 && fc.EndOutageDateTime.After(time.Now()) {
+		if err := fc.Write(ctx, f); err != nil {
+			slog.ErrorContext(ctx, "Failed to cache data", "error", err)
+		}
+		return
+	}
+
+	if err := os.Remove(f.Name()); err != nil {
+		slog.ErrorContext(ctx, "cannot remove the file", "error", err, "file path", SensitivePath(f.Name()))
+	}
+}
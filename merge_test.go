@@ -0,0 +1,159 @@
+package main_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeOutages(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	var outages []*main.FileContent
+	for _, d := range []struct {
+		billID string
+		data   main.Data
+	}{
+		{"123", main.Data{OutageDate: "1404/06/01", OutageStartTime: "11:00", OutageStopTime: "13:00", OutageNumber: 2, Address: "HOME"}},
+		{"123", main.Data{OutageDate: "1404/06/01", OutageStartTime: "09:00", OutageStopTime: "11:00", OutageNumber: 1, Address: "HOME"}},
+		{"123", main.Data{OutageDate: "1404/06/01", OutageStartTime: "12:00", OutageStopTime: "12:30", OutageNumber: 3, Address: "HOME", ReasonOutage: "repair"}},
+		{"123", main.Data{OutageDate: "1404/06/01", OutageStartTime: "15:00", OutageStopTime: "16:00", OutageNumber: 4, Address: "HOME"}},
+		{"456", main.Data{OutageDate: "1404/06/01", OutageStartTime: "13:00", OutageStopTime: "14:00", OutageNumber: 5, Address: "WORK"}},
+	} {
+		fc, err := d.data.ToFileContent(loc, d.billID, []string{"someone@example.com"}, 0)
+		require.NoError(t, err)
+
+		outages = append(outages, fc)
+	}
+
+	merged := main.MergeOutages(outages)
+	require.Len(t, merged, 3)
+
+	// The back-to-back and the overlapping slots are one event, with the number of the first one.
+	require.Equal(t, 1, merged[0].OutageNumber)
+	require.Equal(t, outages[1].StartOutageDateTime, merged[0].StartOutageDateTime)
+	require.Equal(t, outages[0].EndOutageDateTime, merged[0].EndOutageDateTime)
+	require.Equal(t, "HOME", merged[0].Address)
+	require.Equal(t, "repair", merged[0].ReasonOutage)
+	require.Len(t, merged[0].Sources, 3)
+	require.True(t, merged[0].HasSource(2))
+	require.True(t, merged[0].HasSource(3))
+	require.False(t, merged[0].HasSource(4))
+
+	// A slot after a gap, or of another bill, isn't merged.
+	require.Equal(t, 4, merged[1].OutageNumber)
+	require.Empty(t, merged[1].Sources)
+	require.Equal(t, []main.OutageSource{{OutageNumber: 4, Start: outages[3].StartOutageDateTime, End: outages[3].EndOutageDateTime}}, merged[1].SourceRecords())
+	require.Equal(t, "456", merged[2].BillID)
+
+	// The outages aren't changed.
+	require.Empty(t, outages[1].Sources)
+	require.Equal(t, outages[1].StartOutageDateTime.Add(2*time.Hour), outages[1].EndOutageDateTime)
+}
+
+func TestNotifyMergedOutages(t *testing.T) {
+	server := newFakeSMTPServer(t, nil, false)
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	mail := main.NewMailClient(main.SMTP{
+		Name:           "local",
+		Mail:           "barghman@example.com",
+		Address:        "127.0.0.1",
+		Port:           server.port(),
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}, time.UTC, cachePathDir)
+
+	client := main.Clients{Recipients: []string{"someone@example.com"}, Locale: main.LocaleEnglish, MergeSlots: true, Location: time.UTC}
+
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 2)
+	slot := func(number, start, end int) *main.FileContent {
+		return &main.FileContent{
+			UID:                 fmt.Sprintf("123_%d_%s", number, day.Format(time.DateOnly)),
+			BillID:              "123",
+			OutageNumber:        number,
+			StartOutageDateTime: day.Add(time.Duration(start) * time.Hour),
+			EndOutageDateTime:   day.Add(time.Duration(end) * time.Hour),
+			Recipients:          client.Recipients,
+		}
+	}
+
+	// sequences returns the SEQUENCE of the invite of each sent message.
+	sequences := func() []string {
+		var sequences []string
+		for _, msg := range server.Messages() {
+			_, attachment, ok := strings.Cut(msg, "filename=invite.ics\r\n\r\n")
+			require.True(t, ok)
+
+			attachment, _, _ = strings.Cut(attachment, "\r\n--")
+			calendar, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(attachment, "\r\n", ""))
+			require.NoError(t, err)
+
+			_, sequence, _ := strings.Cut(string(calendar), "SEQUENCE:")
+			sequence, _, _ = strings.Cut(sequence, "\r\n")
+			sequences = append(sequences, sequence)
+		}
+
+		return sequences
+	}
+
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, []*main.FileContent{slot(1, 10, 12), slot(2, 12, 14)})
+	require.Equal(t, []string{"0"}, sequences())
+
+	// The same outages aren't sent again.
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, []*main.FileContent{slot(1, 10, 12), slot(2, 12, 14)})
+	require.Equal(t, []string{"0"}, sequences())
+
+	// The second slot is extended, the merged event keeps its start and is sent again as an update.
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, []*main.FileContent{slot(1, 10, 12), slot(2, 12, 15)})
+	require.Equal(t, []string{"0", "1"}, sequences())
+
+	content, err := os.ReadFile(main.ClientCachePath(cachePathDir, "my_client") + main.FileName("123", 1, day))
+	require.NoError(t, err)
+
+	cached := new(main.FileContent)
+	require.NoError(t, json.Unmarshal(content, cached))
+	require.Equal(t, day.Add(15*time.Hour), cached.EndOutageDateTime.UTC())
+	require.Equal(t, uint(1), cached.Sequence)
+	require.Equal(t, map[string]uint{"someone@example.com": 1}, cached.Delivered)
+
+	// A merged slot whose cancellation fails keeps its sequence until the cancellation is sent.
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, []*main.FileContent{slot(3, 16, 17)})
+	require.Equal(t, []string{"0", "1", "0"}, sequences())
+
+	server.mu.Lock()
+	server.reject = "someone@example.com"
+	server.mu.Unlock()
+
+	for range 2 {
+		main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, []*main.FileContent{slot(1, 10, 12), slot(2, 12, 15), slot(3, 15, 17)})
+	}
+
+	content, err = os.ReadFile(main.ClientCachePath(cachePathDir, "my_client") + main.FileName("123", 3, day))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(content, cached))
+	require.Equal(t, uint(0), cached.Sequence)
+
+	server.mu.Lock()
+	server.reject = ""
+	server.mu.Unlock()
+
+	main.NotifyOutages(context.Background(), mail, outbox, cachePathDir, "my_client", client, []*main.FileContent{slot(1, 10, 12), slot(2, 12, 15), slot(3, 15, 17)})
+	require.Contains(t, server.Messages()[len(server.Messages())-1], "method=CANCEL")
+	require.Equal(t, "1", sequences()[len(sequences())-1])
+	require.NoFileExists(t, main.ClientCachePath(cachePathDir, "my_client")+main.FileName("123", 3, day))
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	EncodingQuotedPrintable = "quoted-printable"
+	EncodingBase64          = "base64"
+
+	// headerLineLength is the recommended maximum length of a header line (RFC 5322).
+	headerLineLength = 78
+)
+
+var ErrNoRecipients = errors.New("message has no recipients")
+
+// Message builds a MIME message, the headers are encoded (RFC 2047) and folded,
+// and Bcc recipients only exist in the envelope. Date and MessageID are generated if empty.
+type Message struct {
+	From      *mail.Address
+	To        []*mail.Address
+	Cc        []*mail.Address
+	Bcc       []*mail.Address
+	Subject   string
+	Date      time.Time
+	MessageID string
+	Body      *Part
+}
+
+// Part is a single part of the message, or a multipart if it has sub parts.
+type Part struct {
+	// ContentType is the media type, e.g. "text/plain" or "multipart/mixed".
+	ContentType string
+	// Params of the content type, e.g. charset; the boundary of the multipart is generated.
+	Params map[string]string
+	// Disposition is "inline" or "attachment", it's omitted if empty.
+	Disposition string
+	Filename    string
+	// Encoding is EncodingQuotedPrintable or EncodingBase64, empty means 7bit.
+	Encoding string
+	Body     []byte
+	Parts    []*Part
+}
+
+// ParseAddresses parses the addresses, like "Name <user@example.com>" or "user@example.com".
+func ParseAddresses(addresses []string) ([]*mail.Address, error) {
+	parsed := make([]*mail.Address, 0, len(addresses))
+	for _, address := range addresses {
+		a, err := mail.ParseAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", address, err)
+		}
+
+		parsed = append(parsed, a)
+	}
+
+	return parsed, nil
+}
+
+// EnvelopeAddresses returns the bare addresses of the recipients, e.g. "user@example.com" of
+// "Name <user@example.com>", which are used in RCPT TO and the calendar attendees.
+func EnvelopeAddresses(recipients []string) ([]string, error) {
+	addresses, err := ParseAddresses(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&Message{Bcc: addresses}).Recipients(), nil
+}
+
+// GenerateMessageID returns a unique Message-ID on the domain of the address.
+func GenerateMessageID(address string) string {
+	domain := "barghman.localhost"
+	if _, d, ok := strings.Cut(address, "@"); ok && len(d) != 0 {
+		domain = d
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("<%d.barghman@%s>", time.Now().UnixNano(), domain)
+	}
+
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// Recipients returns the envelope recipients, including Bcc.
+func (m *Message) Recipients() []string {
+	var recipients []string
+	for _, list := range [][]*mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, a := range list {
+			recipients = append(recipients, a.Address)
+		}
+	}
+
+	return recipients
+}
+
+// String generates the message with CRLF line endings.
+func (m *Message) String() (string, error) {
+	if len(m.To)+len(m.Cc)+len(m.Bcc) == 0 {
+		return "", ErrNoRecipients
+	}
+
+	var b strings.Builder
+	writeHeader(&b, "From", m.From.String())
+
+	// A message without To is valid, but some servers add "To: undisclosed-recipients".
+	if len(m.To) != 0 {
+		writeHeader(&b, "To", joinAddresses(m.To))
+	}
+
+	if len(m.Cc) != 0 {
+		writeHeader(&b, "Cc", joinAddresses(m.Cc))
+	}
+
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("UTF-8", m.Subject))
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	messageID := m.MessageID
+	if len(messageID) == 0 {
+		messageID = GenerateMessageID(m.From.Address)
+	}
+
+	writeHeader(&b, "Date", date.Format(time.RFC1123Z))
+	writeHeader(&b, "Message-ID", messageID)
+	writeHeader(&b, "MIME-Version", "1.0")
+
+	if err := m.Body.write(&b); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+func joinAddresses(addresses []*mail.Address) string {
+	s := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		s = append(s, a.String())
+	}
+
+	return strings.Join(s, ", ")
+}
+
+// writeHeader writes the header field, folded on the spaces to keep the lines short.
+func writeHeader(b *strings.Builder, name, value string) {
+	line := name + ":"
+	for _, word := range strings.Split(value, " ") {
+		if len(line)+1+len(word) > headerLineLength && len(strings.TrimSpace(line)) != 0 {
+			b.WriteString(line + "\r\n")
+			line = ""
+		}
+
+		line += " " + word
+	}
+
+	b.WriteString(line + "\r\n")
+}
+
+// header returns the MIME headers of the part.
+func (p *Part) header(boundary string) []string {
+	params := make(map[string]string, len(p.Params)+1)
+	for k, v := range p.Params {
+		params[k] = v
+	}
+
+	if len(p.Parts) != 0 {
+		params["boundary"] = boundary
+	}
+
+	if len(p.Filename) != 0 {
+		params["name"] = p.Filename
+	}
+
+	header := []string{"Content-Type", mime.FormatMediaType(p.ContentType, params)}
+
+	if len(p.Encoding) != 0 {
+		header = append(header, "Content-Transfer-Encoding", p.Encoding)
+	}
+
+	if len(p.Disposition) != 0 {
+		disposition := map[string]string{}
+		if len(p.Filename) != 0 {
+			disposition["filename"] = p.Filename
+		}
+
+		header = append(header, "Content-Disposition", mime.FormatMediaType(p.Disposition, disposition))
+	}
+
+	return header
+}
+
+// write writes the headers and the body of the part, and its sub parts recursively.
+func (p *Part) write(b *strings.Builder) error {
+	boundary := generateBoundary()
+
+	header := p.header(boundary)
+	for i := 0; i < len(header); i += 2 {
+		writeHeader(b, header[i], header[i+1])
+	}
+
+	b.WriteString("\r\n")
+
+	if len(p.Parts) == 0 {
+		return p.writeBody(b)
+	}
+
+	for _, sub := range p.Parts {
+		b.WriteString("--" + boundary + "\r\n")
+		if err := sub.write(b); err != nil {
+			return err
+		}
+	}
+
+	b.WriteString("--" + boundary + "--\r\n")
+	return nil
+}
+
+// writeBody writes the encoded body, the lines are kept shorter than 76 characters.
+func (p *Part) writeBody(b *strings.Builder) error {
+	switch p.Encoding {
+	case EncodingQuotedPrintable:
+		qp := quotedprintable.NewWriter(b)
+		if _, err := qp.Write(p.Body); err != nil {
+			return err
+		}
+
+		if err := qp.Close(); err != nil {
+			return err
+		}
+
+	case EncodingBase64:
+		encoded := base64.StdEncoding.EncodeToString(p.Body)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+
+		b.WriteString(encoded)
+
+	default:
+		b.Write(p.Body)
+	}
+
+	if !strings.HasSuffix(b.String(), "\r\n") {
+		b.WriteString("\r\n")
+	}
+
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsContentType is the text format of Prometheus.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metrics are served on /metrics if listen_address is set.
+var metrics = NewRegistry()
+
+var (
+	apiRequests = metrics.NewCounter("barghman_api_requests_total",
+		`Requests to the outages API by their HTTP status, "error" if no response is received.`, "status")
+	apiDuration = metrics.NewHistogram("barghman_api_request_duration_seconds",
+		"Latency of the requests to the outages API.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+	outagesFetched = metrics.NewCounter("barghman_outages_fetched_total",
+		"Outages which are fetched from the API in the window of the client.", "client")
+	outagesNew = metrics.NewCounter("barghman_outages_new_total",
+		"Outages which are seen for the first time.", "client")
+	outagesUpdated = metrics.NewCounter("barghman_outages_updated_total",
+		"Outages whose time is changed since they're sent.", "client")
+	outagesCancelled = metrics.NewCounter("barghman_outages_cancelled_total",
+		"Outages which are cancelled for some of their recipients.", "client")
+	emailsSent = metrics.NewCounter("barghman_emails_sent_total",
+		"Emails which are sent by the smtp config.", "smtp")
+	emailsFailed = metrics.NewCounter("barghman_emails_failed_total",
+		"Emails which the smtp config failed to send.", "smtp")
+	lastSuccess = metrics.NewGauge("barghman_last_success_timestamp_seconds",
+		"Unix time of the last run of the client which all of its bills are fetched in.", "client")
+	tokenExpired = metrics.NewCounter("barghman_token_expired_total",
+		"Requests of the client which are rejected since its auth_token is expired.", "client")
+)
+
+// RegisterCacheMetrics adds the size of the cache directory to the metrics.
+func RegisterCacheMetrics(registry *Registry, cachePathDir string) {
+	registry.NewGaugeFunc("barghman_cache_size_bytes", "Size of the files in the cache directory.", func() float64 {
+		var size int64
+		filepath.WalkDir(cachePathDir, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+
+			return nil
+		})
+
+		return float64(size)
+	})
+
+	registry.NewGaugeFunc("barghman_cache_outages", "Outages which are kept in the cache.", func() float64 {
+		matches, _ := filepath.Glob(filepath.Join(cachePathDir, clientsDirName, "*", "*.json"))
+		return float64(len(matches))
+	})
+}
+
+// Registry keeps the metrics and writes them in the text format of Prometheus.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all the metrics in the order which they're registered in.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range r.metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+
+	if err := r.Write(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// series is the value of a metric with one set of the label values.
+type series struct {
+	labels []string
+	value  float64
+	// buckets, sum and count are the state of a histogram.
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// metricVec is a metric with all of its series, which are keyed by their label values.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newMetricVec(name, help, kind string, labels []string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+// with returns the series of the label values, they should be as many as the labels.
+func (v *metricVec) with(values []string, update func(s *series)) {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(values)}
+		v.series[key] = s
+	}
+
+	update(s)
+}
+
+// sorted returns the series in the order of their label values, so the output is stable.
+func (v *metricVec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	sorted := make([]*series, len(keys))
+	for i, key := range keys {
+		sorted[i] = v.series[key]
+	}
+
+	// The metrics without labels are shown before they're changed.
+	if len(sorted) == 0 && len(v.labels) == 0 && v.kind != "histogram" {
+		sorted = append(sorted, new(series))
+	}
+
+	return sorted
+}
+
+func (v *metricVec) write(w io.Writer) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeMetricHelp(v.help), v.name, v.kind); err != nil {
+		return err
+	}
+
+	for _, s := range v.sorted() {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", v.name, formatMetricLabels(v.labels, s.labels), formatMetricValue(s.value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Counter is a value which only goes up, e.g. the number of the sent emails.
+type Counter struct {
+	*metricVec
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newMetricVec(name, help, "counter", labels)}
+	r.register(c)
+
+	return c
+}
+
+// Inc adds one to the series of the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) Add(delta float64, values ...string) {
+	c.with(values, func(s *series) { s.value += delta })
+}
+
+// Gauge is a value which goes up and down, e.g. the time of the last run.
+type Gauge struct {
+	*metricVec
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newMetricVec(name, help, "gauge", labels)}
+	r.register(g)
+
+	return g
+}
+
+func (g *Gauge) Set(value float64, values ...string) {
+	g.with(values, func(s *series) { s.value = value })
+}
+
+// gaugeFunc is a gauge which is computed on each scrape.
+type gaugeFunc struct {
+	name, help string
+	f          func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&gaugeFunc{name: name, help: help, f: f})
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, escapeMetricHelp(g.help), g.name, g.name, formatMetricValue(g.f()))
+	return err
+}
+
+// Histogram counts the observed values in the buckets of their upper bounds, e.g. the latency of the requests.
+type Histogram struct {
+	*metricVec
+	bounds []float64
+}
+
+func (r *Registry) NewHistogram(name, help string, bounds []float64, labels ...string) *Histogram {
+	h := &Histogram{newMetricVec(name, help, "histogram", labels), bounds}
+	r.register(h)
+
+	return h
+}
+
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.with(values, func(s *series) {
+		if s.buckets == nil {
+			s.buckets = make([]uint64, len(h.bounds))
+		}
+
+		for i, bound := range h.bounds {
+			if value <= bound {
+				s.buckets[i]++
+			}
+		}
+
+		s.sum += value
+		s.count++
+	})
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, escapeMetricHelp(h.help), h.name); err != nil {
+		return err
+	}
+
+	labels := append(slices.Clip(h.labels), "le")
+	for _, s := range h.sorted() {
+		for i, bound := range h.bounds {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatMetricLabels(labels, append(slices.Clip(s.labels), formatMetricValue(bound))), s.buckets[i]); err != nil {
+				return err
+			}
+		}
+
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, formatMetricLabels(labels, append(slices.Clip(s.labels), "+Inf")), s.count,
+			h.name, formatMetricLabels(h.labels, s.labels), formatMetricValue(s.sum),
+			h.name, formatMetricLabels(h.labels, s.labels), s.count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatMetricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = name + `="` + value + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func escapeMetricHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// NewServeMux returns the handler of the http listener, /healthz and /readyz serve the status
+// with 503 if barghman is unhealthy or isn't ready.
+func NewServeMux(status func() Status) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics)
+	mux.Handle("GET /healthz", StatusHandler(status, func(s Status) bool { return s.Healthy }))
+	mux.Handle("GET /readyz", StatusHandler(status, func(s Status) bool { return s.Healthy && s.Ready }))
+
+	return mux
+}
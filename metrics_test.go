@@ -0,0 +1,91 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := main.NewRegistry()
+
+	runs := registry.NewCounter("test_runs_total", "Runs of the job.")
+	emails := registry.NewCounter("test_emails_total", `Emails by the "smtp" config.`, "smtp")
+	last := registry.NewGauge("test_last_run_seconds", "Unix time of the last run.", "client")
+	latency := registry.NewHistogram("test_latency_seconds", "Latency of the requests.", []float64{0.5, 1})
+	registry.NewGaugeFunc("test_cache_bytes", "Size of the cache.", func() float64 { return 1024 })
+
+	emails.Inc("outlook")
+	emails.Add(2, "gmail")
+	emails.Inc(`quote"d`)
+	last.Set(1700000000, "home")
+	latency.Observe(0.25)
+	latency.Observe(0.75)
+	latency.Observe(3)
+
+	var b bytes.Buffer
+	require.NoError(t, registry.Write(&b))
+	require.Equal(t, `# HELP test_runs_total Runs of the job.
+# TYPE test_runs_total counter
+test_runs_total 0
+# HELP test_emails_total Emails by the "smtp" config.
+# TYPE test_emails_total counter
+test_emails_total{smtp="gmail"} 2
+test_emails_total{smtp="outlook"} 1
+test_emails_total{smtp="quote\"d"} 1
+# HELP test_last_run_seconds Unix time of the last run.
+# TYPE test_last_run_seconds gauge
+test_last_run_seconds{client="home"} 1.7e+09
+# HELP test_latency_seconds Latency of the requests.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.5"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 4
+test_latency_seconds_count 3
+# HELP test_cache_bytes Size of the cache.
+# TYPE test_cache_bytes gauge
+test_cache_bytes 1024
+`, b.String())
+
+	runs.Inc()
+	b.Reset()
+	require.NoError(t, registry.Write(&b))
+	require.Contains(t, b.String(), "\ntest_runs_total 1\n")
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	// Nothing listens on the port, the email fails.
+	mail := main.NewMailClient(main.SMTP{
+		Name:           "metrics-test",
+		Address:        "127.0.0.1",
+		Port:           "1",
+		AuthMethod:     "none",
+		TLSMode:        "none",
+		DialTimeout:    time.Second,
+		CommandTimeout: time.Second,
+	}, time.UTC, t.TempDir())
+	require.Error(t, mail.Send(context.Background(), "Subject: test\r\n\r\nhello\r\n", []string{"someone@example.com"}))
+
+	server := httptest.NewServer(main.NewServeMux(func() main.Status { return main.Status{Healthy: true} }))
+	t.Cleanup(server.Close)
+
+	response, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", response.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `barghman_emails_failed_total{smtp="metrics-test"} 1`)
+	require.Contains(t, string(body), "# TYPE barghman_api_request_duration_seconds histogram")
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const oauth2DirName = "oauth2"
+
+// oauth2ExpiryDelta refreshes the access token a bit before it really expires.
+const oauth2ExpiryDelta = time.Minute
+
+var (
+	ErrOAuth2TokenRefresh = errors.New("oauth2 token refresh failed")
+	ErrOAuth2Unencrypted  = errors.New("xoauth2 needs an encrypted connection")
+)
+
+var oauth2Providers = map[string]struct {
+	TokenURL string
+	Scope    string
+}{
+	"google":    {TokenURL: "https://oauth2.googleapis.com/token"},
+	"microsoft": {TokenURL: "https://login.microsoftonline.com/common/oauth2/v2.0/token", Scope: "https://outlook.office.com/SMTP.Send offline_access"},
+}
+
+// OAuth2Token is the access token which is stored in the state directory.
+type OAuth2Token struct {
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+	// RefreshToken is set when the provider rotates the refresh token (Microsoft does),
+	// it's only used as long as the refresh token of the config is not changed.
+	RefreshToken       string `json:"refresh_token,omitempty"`
+	ConfigRefreshToken string `json:"config_refresh_token"`
+}
+
+// OAuth2TokenSource returns a valid access token and refreshes it when it's expired.
+type OAuth2TokenSource struct {
+	Config SMTP
+	Path   string
+	Client *http.Client
+
+	mu    sync.Mutex
+	token *OAuth2Token
+}
+
+func NewOAuth2TokenSource(config SMTP, cachePathDir string) *OAuth2TokenSource {
+	return &OAuth2TokenSource{
+		Config: config,
+		Path:   filepath.Join(cachePathDir, oauth2DirName, config.Name+".json"),
+		Client: http.DefaultClient,
+	}
+}
+
+// fingerprint is used to detect that the refresh token of the config is changed, without storing it.
+func fingerprint(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *OAuth2TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil {
+		s.token = s.load(ctx)
+	}
+
+	if s.token != nil && len(s.token.AccessToken) != 0 && time.Now().Add(oauth2ExpiryDelta).Before(s.token.Expiry) {
+		return s.token.AccessToken, nil
+	}
+
+	token, err := s.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token
+	if err := s.save(token); err != nil {
+		slog.WarnContext(ctx, "couldn't store oauth2 token, it will be refreshed again next time", "error", err)
+	}
+
+	return token.AccessToken, nil
+}
+
+// Invalidate drops the access token, e.g. when the server rejects it, so the next call
+// of Token refreshes it.
+func (s *OAuth2TokenSource) Invalidate(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil {
+		s.token = s.load(ctx)
+	}
+
+	if s.token == nil {
+		return
+	}
+
+	// The rotated refresh token is still valid, only the access token is dropped.
+	s.token.AccessToken, s.token.Expiry = "", time.Time{}
+	if err := s.save(s.token); err != nil {
+		slog.WarnContext(ctx, "couldn't store the invalidated oauth2 token", "error", err)
+	}
+}
+
+func (s *OAuth2TokenSource) load(ctx context.Context) *OAuth2Token {
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.WarnContext(ctx, "couldn't read oauth2 token", "error", err, "path", s.Path)
+		}
+		return nil
+	}
+
+	token := new(OAuth2Token)
+	if err := json.Unmarshal(content, token); err != nil {
+		slog.WarnContext(ctx, "decode the oauth2 token failed", "error", err, "path", s.Path)
+		return nil
+	}
+
+	if token.ConfigRefreshToken != fingerprint(string(s.Config.OAuthRefreshToken)) {
+		slog.DebugContext(ctx, "refresh token of the config is changed, ignoring the stored token", "smtp", s.Config.Name)
+		return nil
+	}
+
+	return token
+}
+
+func (s *OAuth2TokenSource) save(token *OAuth2Token) error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o700); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.Path)
+}
+
+func (s *OAuth2TokenSource) refresh(ctx context.Context) (*OAuth2Token, error) {
+	tokenURL, scope := s.Config.OAuthTokenURL, s.Config.OAuthScope
+	if provider, ok := oauth2Providers[s.Config.OAuthProvider]; ok {
+		if len(tokenURL) == 0 {
+			tokenURL = provider.TokenURL
+		}
+
+		if len(scope) == 0 {
+			scope = provider.Scope
+		}
+	}
+
+	refreshToken := string(s.Config.OAuthRefreshToken)
+	if s.token != nil && len(s.token.RefreshToken) != 0 {
+		refreshToken = s.token.RefreshToken
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {s.Config.OAuthClientID},
+		"client_secret": {string(s.Config.OAuthClientSecret)},
+	}
+
+	if len(scope) != 0 {
+		form.Set("scope", scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create new request", "error", err)
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	response, err := s.Client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to send token request", "error", err)
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to read response body", "error", err)
+		return nil, err
+	}
+
+	var tokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	if err := json.Unmarshal(body, &tokenResponse); err != nil && response.StatusCode == http.StatusOK {
+		slog.ErrorContext(ctx, "failed to decode token response", "error", err)
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK || len(tokenResponse.AccessToken) == 0 {
+		slog.ErrorContext(ctx, "token endpoint returned an error", "status_code", response.StatusCode, "error", tokenResponse.Error, "description", tokenResponse.ErrorDescription)
+		return nil, fmt.Errorf("%w: %d %s", ErrOAuth2TokenRefresh, response.StatusCode, tokenResponse.Error)
+	}
+
+	slog.DebugContext(ctx, "oauth2 access token refreshed", "smtp", s.Config.Name, "expires in", tokenResponse.ExpiresIn)
+
+	token := &OAuth2Token{
+		AccessToken:        tokenResponse.AccessToken,
+		Expiry:             time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second),
+		RefreshToken:       tokenResponse.RefreshToken,
+		ConfigRefreshToken: fingerprint(string(s.Config.OAuthRefreshToken)),
+	}
+
+	// Keep the rotated refresh token if the provider didn't send a new one.
+	if len(token.RefreshToken) == 0 && s.token != nil {
+		token.RefreshToken = s.token.RefreshToken
+	}
+
+	return token, nil
+}
+
+type xoauth2Auth struct {
+	username string
+	source   *OAuth2TokenSource
+	// ctx is the context of the send, the token is refreshed and logged with it.
+	ctx context.Context
+}
+
+// XOAuth2Auth implements the XOAUTH2 mechanism which is used by Gmail and Microsoft 365.
+func XOAuth2Auth(username string, source *OAuth2TokenSource) smtp.Auth {
+	return &xoauth2Auth{username: username, source: source}
+}
+
+// withContext returns a copy of the auth for the send, so the concurrent sends don't share their contexts.
+func (a *xoauth2Auth) withContext(ctx context.Context) *xoauth2Auth {
+	auth := *a
+	auth.ctx = ctx
+
+	return &auth
+}
+
+func (a *xoauth2Auth) context() context.Context {
+	if a.ctx == nil {
+		return context.Background()
+	}
+
+	return a.ctx
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, ErrOAuth2Unencrypted
+	}
+
+	token, err := a.source.Token(a.context())
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sends the error as a json challenge, an empty response finishes the exchange.
+		// The token might be revoked before its expiry, so it's refreshed on the next attempt.
+		slog.ErrorContext(a.context(), "xoauth2 authentication rejected", "response", string(fromServer))
+		a.source.Invalidate(a.context())
+		return []byte{}, nil
+	}
+
+	return nil, nil
+}
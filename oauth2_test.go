@@ -0,0 +1,107 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"sync/atomic"
+	"testing"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTokenEndpoint(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("client_secret") != "client-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		n := calls.Add(1)
+		assert.Equal(t, "refresh_token", r.Form.Get("grant_type"))
+
+		// The handler runs in the goroutine of the server, so it doesn't stop the test on failure.
+		// The first refresh rotates the refresh token, the next one should use it.
+		if n == 1 {
+			assert.Equal(t, "refresh-token", r.Form.Get("refresh_token"))
+		} else {
+			assert.Equal(t, "rotated-refresh-token", r.Form.Get("refresh_token"))
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "access-token",
+			"expires_in":    3600,
+			"refresh_token": "rotated-refresh-token",
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestOAuth2TokenSource(t *testing.T) {
+	var calls atomic.Int32
+	server := newTokenEndpoint(t, &calls)
+	cachePathDir := t.TempDir()
+
+	config := main.SMTP{
+		Name:              "gmail",
+		OAuthTokenURL:     server.URL,
+		OAuthClientID:     "client-id",
+		OAuthClientSecret: "client-secret",
+		OAuthRefreshToken: "refresh-token",
+	}
+
+	token, err := main.NewOAuth2TokenSource(config, cachePathDir).Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "access-token", token)
+	require.Equal(t, int32(1), calls.Load())
+
+	// A new source loads the stored token instead of refreshing it again.
+	source := main.NewOAuth2TokenSource(config, cachePathDir)
+	token, err = source.Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "access-token", token)
+	require.Equal(t, int32(1), calls.Load())
+
+	auth := main.XOAuth2Auth("user@example.com", source)
+	mech, resp, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	require.NoError(t, err)
+	require.Equal(t, "XOAUTH2", mech)
+	require.Equal(t, "user=user@example.com\x01auth=Bearer access-token\x01\x01", string(resp))
+
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "smtp.example.com"})
+	require.ErrorIs(t, err, main.ErrOAuth2Unencrypted)
+
+	// The server rejects the token, it's refreshed on the next attempt.
+	_, err = auth.Next([]byte(`{"status":"401","schemes":"bearer"}`), true)
+	require.NoError(t, err)
+
+	token, err = main.NewOAuth2TokenSource(config, cachePathDir).Token(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "access-token", token)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestOAuth2TokenSourceRejected(t *testing.T) {
+	var calls atomic.Int32
+	server := newTokenEndpoint(t, &calls)
+
+	_, err := main.NewOAuth2TokenSource(main.SMTP{
+		Name:              "gmail",
+		OAuthTokenURL:     server.URL,
+		OAuthClientSecret: "wrong",
+		OAuthRefreshToken: "refresh-token",
+	}, t.TempDir()).Token(context.Background())
+	require.ErrorIs(t, err, main.ErrOAuth2TokenRefresh)
+}
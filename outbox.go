@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outboxDirName      = "outbox"
+	outboxTickInterval = time.Minute
+)
+
+var ErrOutboxEntryNotFound = errors.New("outbox entry not found")
+
+// errSkipOutboxEntry can be returned by the send function of Process
+// to leave the entry untouched.
+var errSkipOutboxEntry = errors.New("skip outbox entry")
+
+// outboxKind is what the email of an entry is, it decides how its delivery is recorded.
+type outboxKind string
+
+const (
+	// outboxKindInvite is the invite of the outage, it's empty for the entries which are queued
+	// before the other kinds.
+	outboxKindInvite outboxKind = ""
+	outboxKindCancel outboxKind = "cancel"
+	outboxKindDigest outboxKind = "digest"
+)
+
+// OutboxEntry is an email which couldn't be delivered and waits for another try.
+type OutboxEntry struct {
+	ID          string       `json:"id"`
+	Kind        outboxKind   `json:"kind,omitempty"`
+	Client      string       `json:"client"`
+	SMTP        string       `json:"smtp"`
+	Recipients  []string     `json:"recipients"`
+	Message     string       `json:"message"`
+	Content     *FileContent `json:"content"`
+	Attempts    int          `json:"attempts"`
+	CreatedAt   time.Time    `json:"created_at"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	ExpiresAt   time.Time    `json:"expires_at"`
+	LastError   string       `json:"last_error"`
+	// Locale and Fingerprint are the recipient group and the digest of a digest entry, which
+	// has no Content.
+	Locale      Locale `json:"locale,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Outbox keeps failed emails on the disk, each entry in its own json file,
+// so they survive restarts of the service.
+type Outbox struct {
+	Dir         string
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// mu prevents the retry loop and the cron job from touching the same entry at once.
+	mu sync.Mutex
+	// processing lets only one Process send the entries at once, e.g. the retry loop and the
+	// outbox command. It isn't held by the cron job, which only waits for mu.
+	processing sync.Mutex
+}
+
+func NewOutbox(cachePathDir string, baseBackoff, maxBackoff time.Duration) (*Outbox, error) {
+	dir := filepath.Join(cachePathDir, outboxDirName)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Error("cannot create outbox directory", "error", err, "outbox directory", dir)
+		return nil, err
+	}
+
+	return &Outbox{Dir: dir, BaseBackoff: baseBackoff, MaxBackoff: maxBackoff}, nil
+}
+
+// OutboxID returns the outbox identifier of the file content and its recipients in the client, a newer
+// version of the same event replaces the older one which is still waiting in the outbox.
+// It doesn't have the date, so an outage which is moved to another day replaces it too.
+func OutboxID(client string, fc *FileContent) string {
+	recipients := slices.Clone(fc.Recipients)
+	slices.Sort(recipients)
+
+	return fmt.Sprintf("%s_%d_%s", fc.BillID, fc.OutageNumber, fingerprint(client+":"+strings.Join(recipients, ",")))
+}
+
+// outboxCancelID returns the outbox identifier of the cancellation of the event for its recipients.
+func outboxCancelID(client string, fc *FileContent) string {
+	return OutboxID(client, fc) + "_cancel"
+}
+
+// outboxDigestID returns the outbox identifier of the digest of the client in the locale, a newer
+// digest replaces the older one.
+func outboxDigestID(client string, locale Locale) string {
+	return "digest_" + safeFileName(client) + "_" + safeFileName(string(locale))
+}
+
+// path returns the file of the entry, the ids of the outbox command can't escape the outbox.
+func (o *Outbox) path(id string) string {
+	return filepath.Join(o.Dir, filepath.Base(id)+".json")
+}
+
+// Backoff returns how long to wait after the given number of failed attempts.
+func (o *Outbox) Backoff(attempts int) time.Duration {
+	backoff := o.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= o.MaxBackoff {
+			return o.MaxBackoff
+		}
+	}
+
+	return min(backoff, o.MaxBackoff)
+}
+
+// Enqueue stores a failed email, the entry will be retried after the first backoff.
+func (o *Outbox) Enqueue(ctx context.Context, client, smtpName, msg string, fc *FileContent, sendErr error) error {
+	entry := o.entry(client, smtpName, msg, fc)
+	entry.Attempts = 1
+	entry.NextAttempt = entry.CreatedAt.Add(o.Backoff(1))
+
+	if sendErr != nil {
+		entry.LastError = sendErr.Error()
+	}
+
+	slog.InfoContext(ctx, "email queued in outbox", "id", SensitivePath(entry.ID), "next attempt", entry.NextAttempt)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.save(ctx, entry)
+}
+
+// Defer stores an email which isn't tried yet, it's sent at the given time, e.g. after the quiet hours.
+func (o *Outbox) Defer(ctx context.Context, client, smtpName, msg string, fc *FileContent, until time.Time) error {
+	return o.deferEntry(ctx, o.entry(client, smtpName, msg, fc), until)
+}
+
+// DeferCancel stores the cancellation of the event for the recipients of the file content,
+// their delivery is forgotten once it's sent.
+func (o *Outbox) DeferCancel(ctx context.Context, client, smtpName, msg string, fc *FileContent, until time.Time) error {
+	entry := o.entry(client, smtpName, msg, fc)
+	entry.ID, entry.Kind = outboxCancelID(client, fc), outboxKindCancel
+
+	return o.deferEntry(ctx, entry, until)
+}
+
+// DeferDigest stores the digest of the recipient group, it's recorded in the digest state of
+// the client with the fingerprint once it's sent. It doesn't expire.
+func (o *Outbox) DeferDigest(ctx context.Context, client, smtpName, msg string, group RecipientGroup, fingerprint string, until time.Time) error {
+	return o.deferEntry(ctx, &OutboxEntry{
+		ID:          outboxDigestID(client, group.Locale),
+		Kind:        outboxKindDigest,
+		Client:      client,
+		SMTP:        smtpName,
+		Recipients:  group.Recipients,
+		Message:     msg,
+		CreatedAt:   time.Now(),
+		Locale:      group.Locale,
+		Fingerprint: fingerprint,
+	}, until)
+}
+
+func (o *Outbox) deferEntry(ctx context.Context, entry *OutboxEntry, until time.Time) error {
+	entry.NextAttempt = until
+
+	slog.InfoContext(ctx, "email deferred in outbox", "id", SensitivePath(entry.ID), "next attempt", entry.NextAttempt)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.save(ctx, entry)
+}
+
+func (o *Outbox) entry(client, smtpName, msg string, fc *FileContent) *OutboxEntry {
+	return &OutboxEntry{
+		ID:         OutboxID(client, fc),
+		Client:     client,
+		SMTP:       smtpName,
+		Recipients: fc.Recipients,
+		Message:    msg,
+		Content:    fc,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  fc.StartOutageDateTime,
+	}
+}
+
+func (o *Outbox) save(ctx context.Context, entry *OutboxEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "Encode outbox entry failed", "error", err)
+		return err
+	}
+
+	// Write into a temporary file first, so a crash never leaves a half written entry.
+	tmp := o.path(entry.ID) + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		slog.ErrorContext(ctx, "Failed to write outbox entry", "error", err, "id", SensitivePath(entry.ID))
+		return err
+	}
+
+	if err := os.Rename(tmp, o.path(entry.ID)); err != nil {
+		slog.ErrorContext(ctx, "Failed to rename outbox entry", "error", err, "id", SensitivePath(entry.ID))
+		return err
+	}
+
+	return nil
+}
+
+// Get loads a single entry of the outbox.
+func (o *Outbox) Get(id string) (*OutboxEntry, error) {
+	content, err := os.ReadFile(o.path(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrOutboxEntryNotFound
+		}
+
+		return nil, err
+	}
+
+	entry := new(OutboxEntry)
+	if err := json.Unmarshal(content, entry); err != nil {
+		slog.Error("decode the outbox entry failed", "error", err, "id", SensitivePath(id))
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// List returns all entries of the outbox sorted by their next attempt.
+func (o *Outbox) List() ([]*OutboxEntry, error) {
+	files, err := os.ReadDir(o.Dir)
+	if err != nil {
+		slog.Error("couldn't read outbox directory", "error", err)
+		return nil, err
+	}
+
+	entries := make([]*OutboxEntry, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+
+		entry, err := o.Get(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b *OutboxEntry) int {
+		return a.NextAttempt.Compare(b.NextAttempt)
+	})
+
+	return entries, nil
+}
+
+// Drop removes an entry from the outbox.
+func (o *Outbox) Drop(ctx context.Context, id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.drop(ctx, id)
+}
+
+func (o *Outbox) drop(ctx context.Context, id string) error {
+	if err := os.Remove(o.path(id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrOutboxEntryNotFound
+		}
+
+		slog.ErrorContext(ctx, "cannot remove outbox entry", "error", err, "id", SensitivePath(id))
+		return err
+	}
+
+	return nil
+}
+
+// Pending reports whether the same version of the event is already waiting in the outbox for the client.
+func (o *Outbox) Pending(client string, fc *FileContent) bool {
+	entry, err := o.Get(OutboxID(client, fc))
+	if err != nil {
+		return false
+	}
+
+	return entry.Content.StartOutageDateTime.Equal(fc.StartOutageDateTime) &&
+		entry.Content.EndOutageDateTime.Equal(fc.EndOutageDateTime)
+}
+
+// Process tries to send every entry which is due, or every entry if force is true.
+// Expired entries, the ones that their outage is already started, are dropped.
+// Successfully sent entries are written into the cache and removed from the outbox.
+// The entries are sent without holding the lock, so the cron job isn't blocked by a slow
+// smtp server; an entry which the cron job replaces meanwhile is left for its next attempt.
+func (o *Outbox) Process(ctx context.Context, cachePathDir string, force bool, send func(context.Context, *OutboxEntry) error) error {
+	o.processing.Lock()
+	defer o.processing.Unlock()
+
+	o.mu.Lock()
+	entries, err := o.List()
+	o.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		ctx := WithLogAttrs(ctx, "client", entry.Client)
+		if entry.Content != nil {
+			ctx = withOutageLogAttrs(ctx, entry.Content)
+		}
+
+		now := time.Now()
+
+		if !entry.ExpiresAt.IsZero() && entry.ExpiresAt.Before(now) {
+			slog.WarnContext(ctx, "outbox entry expired, dropping it", "id", SensitivePath(entry.ID), "attempts", entry.Attempts, "last error", entry.LastError)
+			if err := o.dropListed(ctx, entry); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if !force && entry.NextAttempt.After(now) {
+			continue
+		}
+
+		if err := send(ctx, entry); err != nil {
+			if errors.Is(err, errSkipOutboxEntry) {
+				continue
+			}
+
+			entry.Attempts++
+			entry.LastError = err.Error()
+			entry.NextAttempt = now.Add(o.Backoff(entry.Attempts))
+
+			slog.ErrorContext(ctx, "outbox retry failed", "error", err, "id", SensitivePath(entry.ID), "attempts", entry.Attempts, "next attempt", entry.NextAttempt)
+			errs = append(errs, fmt.Errorf("%s: %w", SensitivePath(entry.ID).LogValue(), err))
+
+			if err := o.saveListed(ctx, entry); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		slog.InfoContext(ctx, "outbox entry sent", "id", SensitivePath(entry.ID), "attempts", entry.Attempts+1)
+
+		o.mu.Lock()
+		if err := entry.record(ctx, cachePathDir); err != nil {
+			slog.ErrorContext(ctx, "Failed to cache data", "error", err)
+		}
+		o.mu.Unlock()
+
+		if err := o.dropListed(ctx, entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// replaced reports whether the listed entry is replaced or removed by the cron job since then,
+// it should be called with the lock held.
+func (o *Outbox) replaced(entry *OutboxEntry) bool {
+	stored, err := o.Get(entry.ID)
+	return err != nil || !stored.CreatedAt.Equal(entry.CreatedAt)
+}
+
+// saveListed stores the next attempt of the listed entry, unless it's replaced since then.
+func (o *Outbox) saveListed(ctx context.Context, entry *OutboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.replaced(entry) {
+		return nil
+	}
+
+	return o.save(ctx, entry)
+}
+
+// dropListed removes the listed entry, unless it's replaced since then.
+func (o *Outbox) dropListed(ctx context.Context, entry *OutboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.replaced(entry) {
+		return nil
+	}
+
+	return o.drop(ctx, entry.ID)
+}
+
+// record keeps the delivery of the sent entry, in the cache of its outage or in the digest state.
+func (e *OutboxEntry) record(ctx context.Context, cachePathDir string) error {
+	switch e.Kind {
+	case outboxKindCancel:
+		return e.Content.CacheCancellation(ctx, ClientCachePath(cachePathDir, e.Client), e.Recipients)
+
+	case outboxKindDigest:
+		state, err := LoadDigestState(ctx, cachePathDir, e.Client)
+		if err != nil {
+			return err
+		}
+
+		if state.Groups == nil {
+			state.Groups = make(map[Locale]string)
+		}
+
+		state.Groups[e.Locale] = e.Fingerprint
+
+		return state.Save(ctx, cachePathDir, e.Client)
+
+	default:
+		return e.Content.CacheDelivery(ctx, ClientCachePath(cachePathDir, e.Client), e.Recipients)
+	}
+}
+
+// quietUntil returns the end of the quiet hours of the client if the entry should wait for it,
+// a digest has no outage of its own to start in them.
+func (e *OutboxEntry) quietUntil(client Clients, now time.Time) time.Time {
+	if e.Content == nil {
+		return client.quietHoursEnd(now)
+	}
+
+	return client.quietUntil(now, e.Content)
+}
+
+// Loop processes the outbox periodically until the context is done,
+// it runs independent of the cron job that fetches outages.
+func (o *Outbox) Loop(ctx context.Context, cachePathDir string, send func(context.Context, *OutboxEntry) error) {
+	ticker := time.NewTicker(outboxTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := o.Process(ctx, cachePathDir, false, send); err != nil {
+				slog.Debug("outbox processed with errors", "error", err)
+			}
+		}
+	}
+}
+
+// OutboxSender sends an outbox entry using the smtp config that it was queued with.
+// The entries of a client in its quiet hours at now are left until they end, unless they're urgent.
+func OutboxSender(config Config, location *time.Location, cachePathDir string, now func() time.Time) func(context.Context, *OutboxEntry) error {
+	return func(ctx context.Context, entry *OutboxEntry) error {
+		smtp, ok := config.SMTP[entry.SMTP]
+		if !ok {
+			return fmt.Errorf("smtp config %q not found", entry.SMTP)
+		}
+
+		if client, ok := config.Clients[entry.Client]; ok && !entry.quietUntil(client, now()).IsZero() {
+			return errSkipOutboxEntry
+		}
+
+		return NewMailClient(smtp, location, cachePathDir).Send(ctx, entry.Message, entry.Recipients)
+	}
+}
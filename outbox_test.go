@@ -0,0 +1,328 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxRetry(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, 4*time.Minute)
+	require.NoError(t, err)
+
+	require.Equal(t, time.Minute, outbox.Backoff(1))
+	require.Equal(t, 2*time.Minute, outbox.Backoff(2))
+	require.Equal(t, 4*time.Minute, outbox.Backoff(5))
+
+	fc := &main.FileContent{
+		BillID:              "123",
+		OutageNumber:        1,
+		StartOutageDateTime: time.Now().Add(time.Hour),
+		EndOutageDateTime:   time.Now().Add(2 * time.Hour),
+		Recipients:          []string{"someone@example.com"},
+	}
+
+	require.NoError(t, outbox.Enqueue(context.Background(), "client", "gmail", "message", fc, errors.New("connection refused")))
+	require.True(t, outbox.Pending("client", fc))
+
+	// The entry isn't due yet, so it shouldn't be sent.
+	require.NoError(t, outbox.Process(context.Background(), cachePathDir, false, func(context.Context, *main.OutboxEntry) error {
+		t.Fatal("entry sent before its next attempt")
+		return nil
+	}))
+
+	err = outbox.Process(context.Background(), cachePathDir, true, func(context.Context, *main.OutboxEntry) error {
+		return errors.New("still down")
+	})
+	require.ErrorContains(t, err, "still down")
+	// The error is logged by the callers, the bill id of the entry is masked.
+	require.NotContains(t, err.Error(), "123")
+
+	entries, err := outbox.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, 2, entries[0].Attempts)
+	require.Equal(t, "still down", entries[0].LastError)
+
+	var sent string
+	require.NoError(t, outbox.Process(context.Background(), cachePathDir, true, func(_ context.Context, e *main.OutboxEntry) error {
+		sent = e.Message
+		return nil
+	}))
+	require.Equal(t, "message", sent)
+
+	entries, err = outbox.List()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	_, err = os.Stat(main.ClientCachePath(cachePathDir, "client") + fc.FileName())
+	require.NoError(t, err, "sent entry should be cached")
+}
+
+func TestOutboxKeepsDeliveries(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	fc := &main.FileContent{
+		BillID:              "123",
+		OutageNumber:        1,
+		Sequence:            1,
+		StartOutageDateTime: time.Now().Add(time.Hour),
+		EndOutageDateTime:   time.Now().Add(2 * time.Hour),
+		Recipients:          []string{"a@example.com", "b@example.com"},
+	}
+
+	// a received the event in the job run, b is queued.
+	require.NoError(t, fc.CacheDelivery(context.Background(), main.ClientCachePath(cachePathDir, "client"), []string{"a@example.com"}))
+
+	queued := *fc
+	queued.Recipients = []string{"b@example.com"}
+	require.NoError(t, outbox.Enqueue(context.Background(), "client", "gmail", "message", &queued, errors.New("connection refused")))
+	require.NoError(t, outbox.Process(context.Background(), cachePathDir, true, func(context.Context, *main.OutboxEntry) error { return nil }))
+
+	content, err := os.ReadFile(main.ClientCachePath(cachePathDir, "client") + fc.FileName())
+	require.NoError(t, err)
+
+	result := new(main.FileContent)
+	require.NoError(t, json.Unmarshal(content, result))
+	require.Equal(t, map[string]uint{"a@example.com": 1, "b@example.com": 1}, result.Delivered)
+	require.Empty(t, result.Undelivered([]string{"a@example.com", "b@example.com"}))
+
+	// The new recipients and the ones with an older sequence are undelivered.
+	result.Sequence = 2
+	require.Equal(t, []string{"a@example.com", "c@example.com"}, result.Undelivered([]string{"a@example.com", "c@example.com"}))
+	require.Equal(t, []string{"b@example.com"}, result.Removed([]string{"a@example.com", "c@example.com"}))
+
+	// An older sequence never replaces the cache.
+	fc.Sequence = 0
+	require.NoError(t, fc.CacheDelivery(context.Background(), main.ClientCachePath(cachePathDir, "client"), []string{"c@example.com"}))
+
+	content, err = os.ReadFile(main.ClientCachePath(cachePathDir, "client") + fc.FileName())
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "c@example.com")
+}
+
+func TestOutboxExpired(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	fc := &main.FileContent{
+		BillID:              "123",
+		OutageNumber:        1,
+		StartOutageDateTime: time.Now().Add(-time.Minute),
+		EndOutageDateTime:   time.Now().Add(time.Hour),
+	}
+
+	require.NoError(t, outbox.Enqueue(context.Background(), "client", "gmail", "message", fc, nil))
+	require.NoError(t, outbox.Process(context.Background(), cachePathDir, true, func(context.Context, *main.OutboxEntry) error {
+		t.Fatal("expired entry shouldn't be sent")
+		return nil
+	}))
+
+	require.ErrorIs(t, outbox.Drop(context.Background(), main.OutboxID("client", fc)), main.ErrOutboxEntryNotFound)
+}
+
+func TestOutboxDefer(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	fc := &main.FileContent{
+		BillID:              "123",
+		OutageNumber:        1,
+		StartOutageDateTime: time.Now().Add(3 * time.Hour),
+		EndOutageDateTime:   time.Now().Add(4 * time.Hour),
+		Recipients:          []string{"someone@example.com"},
+	}
+
+	require.NoError(t, outbox.Defer(context.Background(), "client", "gmail", "message", fc, time.Now().Add(time.Hour)))
+	require.True(t, outbox.Pending("client", fc))
+
+	require.NoError(t, outbox.Process(context.Background(), cachePathDir, false, func(context.Context, *main.OutboxEntry) error {
+		t.Fatal("entry sent before the quiet hours end")
+		return nil
+	}))
+
+	// The quiet hours of the client are now.
+	night := time.Date(2025, time.August, 23, 2, 0, 0, 0, time.UTC)
+	config := main.Config{
+		SMTP: map[string]main.SMTP{"gmail": {}},
+		Clients: map[string]main.Clients{"client": {
+			Location:   time.UTC,
+			QuietHours: main.DailyRange{Start: 23 * time.Hour, End: 7 * time.Hour},
+		}},
+	}
+
+	require.NoError(t, outbox.Process(context.Background(), cachePathDir, true, main.OutboxSender(config, time.UTC, cachePathDir, func() time.Time { return night })))
+
+	entries, err := outbox.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Zero(t, entries[0].Attempts)
+}
+
+func TestOutboxDeferCancel(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	fc := &main.FileContent{
+		BillID:              "123",
+		OutageNumber:        1,
+		Sequence:            1,
+		StartOutageDateTime: time.Now().Add(3 * time.Hour),
+		EndOutageDateTime:   time.Now().Add(4 * time.Hour),
+		Recipients:          []string{"a@example.com", "b@example.com"},
+	}
+
+	require.NoError(t, fc.CacheDelivery(context.Background(), main.ClientCachePath(cachePathDir, "client"), fc.Recipients))
+
+	// b is removed in the quiet hours, the cancellation waits in the outbox.
+	removed := *fc
+	removed.Recipients = []string{"b@example.com"}
+	require.NoError(t, outbox.DeferCancel(context.Background(), "client", "gmail", "message", &removed, time.Now().Add(time.Hour)))
+	require.False(t, outbox.Pending("client", &removed), "the cancellation isn't an invite")
+
+	require.NoError(t, outbox.Process(context.Background(), cachePathDir, true, func(context.Context, *main.OutboxEntry) error { return nil }))
+
+	content, err := os.ReadFile(main.ClientCachePath(cachePathDir, "client") + fc.FileName())
+	require.NoError(t, err)
+
+	result := new(main.FileContent)
+	require.NoError(t, json.Unmarshal(content, result))
+	require.Equal(t, map[string]uint{"a@example.com": 1}, result.Delivered)
+
+	entries, err := outbox.List()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestOutboxProcessUnlocked(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	fc := &main.FileContent{
+		BillID:              "123",
+		OutageNumber:        1,
+		StartOutageDateTime: time.Now().Add(time.Hour),
+		EndOutageDateTime:   time.Now().Add(2 * time.Hour),
+		Recipients:          []string{"someone@example.com"},
+	}
+
+	require.NoError(t, outbox.Enqueue(context.Background(), "client", "gmail", "old", fc, nil))
+
+	sending, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- outbox.Process(context.Background(), cachePathDir, true, func(context.Context, *main.OutboxEntry) error {
+			close(sending)
+			<-release
+			return errors.New("connection timed out")
+		})
+	}()
+
+	<-sending
+
+	// The cron job replaces the entry while the smtp server hangs, it isn't blocked by it.
+	queued := make(chan error)
+	go func() { queued <- outbox.Enqueue(context.Background(), "client", "gmail", "new", fc, nil) }()
+
+	select {
+	case err := <-queued:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue is blocked by the sending entry")
+	}
+
+	close(release)
+	require.Error(t, <-done)
+
+	// The failure of the old entry doesn't overwrite the new one.
+	entries, err := outbox.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "new", entries[0].Message)
+	require.Equal(t, 1, entries[0].Attempts)
+	require.Empty(t, entries[0].LastError)
+}
+
+func TestOutboxMovedOutage(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	fc := &main.FileContent{
+		BillID:              "123",
+		OutageNumber:        1,
+		StartOutageDateTime: time.Now().Add(time.Hour),
+		EndOutageDateTime:   time.Now().Add(2 * time.Hour),
+		Recipients:          []string{"someone@example.com"},
+	}
+
+	require.NoError(t, outbox.Enqueue(context.Background(), "client", "gmail", "today", fc, nil))
+
+	// The outage is moved to the next day, its invite replaces the stale one.
+	moved := *fc
+	moved.StartOutageDateTime = fc.StartOutageDateTime.AddDate(0, 0, 1)
+	moved.EndOutageDateTime = fc.EndOutageDateTime.AddDate(0, 0, 1)
+	require.False(t, outbox.Pending("client", &moved))
+	require.NoError(t, outbox.Enqueue(context.Background(), "client", "gmail", "tomorrow", &moved, nil))
+
+	entries, err := outbox.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "tomorrow", entries[0].Message)
+	require.False(t, outbox.Pending("client", fc))
+	require.True(t, outbox.Pending("client", &moved))
+}
+
+func TestOutboxDigestClientName(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	group := main.RecipientGroup{Locale: main.LocaleEnglish, Recipients: []string{"someone@example.com"}}
+	for _, client := range []string{"../../escaped", "home/../..", "home"} {
+		require.NoError(t, outbox.DeferDigest(context.Background(), client, "gmail", "digest", group, "fingerprint", time.Now().Add(time.Hour)))
+		require.NoError(t, (&main.DigestState{Fingerprint: "fingerprint"}).Save(context.Background(), cachePathDir, client))
+	}
+
+	// The names can't escape the outbox or the digest directory, and they don't collide.
+	entries, err := outbox.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	digests, err := os.ReadDir(cachePathDir + "digest")
+	require.NoError(t, err)
+	require.Len(t, digests, 3)
+
+	cached, err := os.ReadDir(cachePathDir)
+	require.NoError(t, err)
+	for _, f := range cached {
+		require.Contains(t, []string{"outbox", "digest"}, f.Name())
+	}
+
+	state, err := main.LoadDigestState(context.Background(), cachePathDir, "../../escaped")
+	require.NoError(t, err)
+	require.Equal(t, "fingerprint", state.Fingerprint)
+
+	require.ErrorIs(t, outbox.Drop(context.Background(), "../../outbox"), main.ErrOutboxEntryNotFound)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+)
+
+type smtpSession struct {
+	client *smtp.Client
+	sent   int
+}
+
+// SMTPPool keeps one smtp connection per smtp config during a job run,
+// so a run with many outages doesn't dial, start TLS and authenticate for each email.
+type SMTPPool struct {
+	mu       sync.Mutex
+	sessions map[string]*smtpSession
+}
+
+func NewSMTPPool() *SMTPPool {
+	return &SMTPPool{sessions: make(map[string]*smtpSession)}
+}
+
+// Send sends the message over the session of the smtp config of the mail client.
+// If the server dropped the reused connection, it reconnects and tries once more.
+func (p *SMTPPool) Send(ctx context.Context, m Mail, msg string, recipients []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	session, reused, err := p.session(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	err = m.transaction(ctx, session.client, msg, recipients)
+	if err != nil && reused && isConnectionError(err) {
+		slog.InfoContext(ctx, "smtp connection is dropped, reconnecting", "smtp", m.Config.Name, "error", err)
+		p.closeSession(m.Config.Name, false)
+
+		if session, _, err = p.session(ctx, m); err != nil {
+			return err
+		}
+
+		err = m.transaction(ctx, session.client, msg, recipients)
+	}
+
+	if err != nil {
+		// A rejected command leaves the connection usable, the next message resets it.
+		if isConnectionError(err) {
+			p.closeSession(m.Config.Name, false)
+		}
+
+		return err
+	}
+
+	session.sent++
+	if m.Config.MaxMessagesPerConnection > 0 && session.sent >= m.Config.MaxMessagesPerConnection {
+		slog.DebugContext(ctx, "smtp connection reached its messages limit", "smtp", m.Config.Name, "sent", session.sent)
+		p.closeSession(m.Config.Name, true)
+	}
+
+	return nil
+}
+
+// session returns the open session of the smtp config, it resets the reused sessions
+// with RSET and dials a new one if there isn't any or the old one is dropped.
+func (p *SMTPPool) session(ctx context.Context, m Mail) (*smtpSession, bool, error) {
+	if session, ok := p.sessions[m.Config.Name]; ok {
+		err := session.client.Reset()
+		if err == nil {
+			return session, true, nil
+		}
+
+		slog.DebugContext(ctx, "smtp reset failed, reconnecting", "smtp", m.Config.Name, "error", err)
+		p.closeSession(m.Config.Name, false)
+	}
+
+	client, err := m.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	session := &smtpSession{client: client}
+	p.sessions[m.Config.Name] = session
+
+	return session, false, nil
+}
+
+func (p *SMTPPool) closeSession(name string, quit bool) {
+	session, ok := p.sessions[name]
+	if !ok {
+		return
+	}
+
+	delete(p.sessions, name)
+
+	if quit {
+		if err := session.client.Quit(); err == nil {
+			return
+		}
+	}
+
+	session.client.Close()
+}
+
+// Close quits all the open sessions, it should be called at the end of each job run.
+func (p *SMTPPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name := range p.sessions {
+		p.closeSession(name, true)
+	}
+}
+
+// isConnectionError reports whether the error is caused by the connection,
+// rather than the server rejecting the command with a reply code.
+func isConnectionError(err error) bool {
+	var protoErr *textproto.Error
+	return !errors.As(err, &protoErr)
+}
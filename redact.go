@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// LogSensitive logs the bill ids, the addresses and the bodies as they are, it's set by log_sensitive.
+// They're masked by default, since the logs might be shipped to a shared journal.
+var LogSensitive bool
+
+// maxLogBodySize is the number of the bytes of a body which are logged, the rest is truncated.
+const maxLogBodySize = 2048
+
+// Sensitive is a personal value, e.g. a bill id, an address or an email address, which is
+// masked in the logs unless log_sensitive is set.
+type Sensitive string
+
+func (s Sensitive) LogValue() slog.Value {
+	if LogSensitive {
+		return slog.StringValue(string(s))
+	}
+
+	return slog.StringValue(mask(string(s)))
+}
+
+// SensitiveList is a list of the personal values, e.g. the recipients.
+type SensitiveList []string
+
+func (l SensitiveList) LogValue() slog.Value {
+	values := make([]string, len(l))
+	for i, v := range l {
+		values[i] = Sensitive(v).LogValue().String()
+	}
+
+	return slog.StringValue(strings.Join(values, ","))
+}
+
+// SensitivePath is a file of the cache or an entry of the outbox, which their names start with
+// the bill id, e.g. "123_1_2025-08-23.json". Only the bill id is masked, so the entry can still
+// be found in the outbox.
+type SensitivePath string
+
+func (p SensitivePath) LogValue() slog.Value {
+	if LogSensitive {
+		return slog.StringValue(string(p))
+	}
+
+	dir, name := filepath.Split(string(p))
+	billID, rest, ok := strings.Cut(name, "_")
+	// The digests are named after the client, they don't have a bill id.
+	if !ok || billID == "digest" {
+		return slog.StringValue(string(p))
+	}
+
+	return slog.StringValue(dir + mask(billID) + "_" + rest)
+}
+
+// LogBody is a body which is logged only if log_sensitive is set, e.g. the response of the
+// provider or the generated email. A very large body is truncated.
+type LogBody string
+
+func (b LogBody) LogValue() slog.Value {
+	if !LogSensitive {
+		return slog.StringValue(fmt.Sprintf("[%d bytes]", len(b)))
+	}
+
+	if len(b) <= maxLogBodySize {
+		return slog.StringValue(string(b))
+	}
+
+	// Cut on a character boundary.
+	n := maxLogBodySize
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+
+	return slog.StringValue(fmt.Sprintf("%s... (%d more bytes)", b[:n], len(b)-n))
+}
+
+// mask keeps only the last four characters of the value, e.g. "******7890",
+// or the first letter and the domain of an email address, e.g. "s***@example.com".
+func mask(value string) string {
+	if len(value) == 0 {
+		return ""
+	}
+
+	if local, domain, ok := strings.Cut(value, "@"); ok && len(local) != 0 {
+		r, _ := utf8.DecodeRuneInString(local)
+		return string(r) + "***@" + domain
+	}
+
+	runes := []rune(value)
+	if len(runes) <= 4 {
+		return strings.Repeat("*", len(runes))
+	}
+
+	return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+}
+
+func (c Config) LogValue() slog.Value {
+	smtps := make([]slog.Attr, 0, len(c.SMTP))
+	for name, smtp := range c.SMTP {
+		smtps = append(smtps, slog.Any(name, smtp))
+	}
+
+	clients := make([]slog.Attr, 0, len(c.Clients))
+	for name, client := range c.Clients {
+		clients = append(clients, slog.Any(name, client))
+	}
+
+	return slog.GroupValue(
+		slog.String("log_level", c.LogLevel.String()),
+		slog.String("log_format", string(c.LogFormat)),
+		slog.String("log_output", c.LogOutput),
+		slog.Bool("log_sensitive", c.LogSensitive),
+		slog.String("cron_job", c.CronJob),
+		slog.Int("wait_time", c.WaitTime),
+		slog.String("timezone", c.Timezone),
+		slog.Duration("delete_duration_period", c.DeleteDurationPeriod),
+		slog.Duration("outbox_base_backoff", c.OutboxBaseBackoff),
+		slog.Duration("outbox_max_backoff", c.OutboxMaxBackoff),
+		slog.String("listen_address", c.ListenAddress),
+		slog.Attr{Key: "smtp", Value: slog.GroupValue(smtps...)},
+		slog.Attr{Key: "clients", Value: slog.GroupValue(clients...)},
+	)
+}
+
+func (s SMTP) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Any("mail", Sensitive(s.Mail)),
+		slog.String("host", s.Address),
+		slog.String("port", s.Port),
+		slog.Any("username", Sensitive(s.Username)),
+		slog.Any("password", s.Password),
+		slog.String("auth_method", string(s.AuthMethod)),
+		slog.String("tls_mode", string(s.TLSMode)),
+		slog.Bool("skip_tls", s.SkipTLS),
+		slog.String("dkim_domain", s.DKIMDomain),
+		slog.String("oauth_provider", s.OAuthProvider),
+		slog.Any("oauth_client_secret", s.OAuthClientSecret),
+		slog.Any("oauth_refresh_token", s.OAuthRefreshToken),
+	)
+}
+
+func (c Clients) LogValue() slog.Value {
+	billIDs := c.BillIDs
+	if len(c.BillID) != 0 {
+		billIDs = append([]string{c.BillID}, billIDs...)
+	}
+
+	return slog.GroupValue(
+		slog.String("smtp", c.SMTP),
+		slog.Any("bill_ids", SensitiveList(billIDs)),
+		slog.Any("auth_token", c.AuthToken),
+		slog.Any("recipients", SensitiveList(c.Recipients)),
+		slog.String("locale", string(c.Locale)),
+		slog.String("mode", string(c.Mode)),
+		slog.String("timezone", c.Timezone),
+		slog.String("cron_job", c.CronJob),
+		slog.String("quiet_hours", c.QuietHours.String()),
+	)
+}
+
+// LogValue identifies the outage in the logs, without its personal data.
+func (f *FileContent) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Any("bill_id", Sensitive(f.BillID)),
+		slog.Int("outage_number", f.OutageNumber),
+		slog.String("date", f.StartOutageDateTime.Format("2006-01-02")),
+	)
+}
@@ -0,0 +1,61 @@
+package main_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactLogs(t *testing.T) {
+	config := main.Config{
+		LogLevel: -4,
+		SMTP: map[string]main.SMTP{"gmail": {
+			Mail:     "sender@example.com",
+			Username: "sender@example.com",
+			Password: "smtp-password",
+		}},
+		Clients: map[string]main.Clients{"home": {
+			SMTP:       "gmail",
+			BillIDs:    []string{"1234567890"},
+			AuthToken:  "auth-token",
+			Recipients: []string{"me@example.com"},
+		}},
+	}
+
+	body := strings.Repeat("خ", 3000)
+
+	log := func() string {
+		var b bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&b, nil))
+		logger.Info("config", "config", config, "bill id", main.Sensitive("1234567890"), "body", main.LogBody(body),
+			"file path", main.SensitivePath("/cache/barghman/1234567890_1_2025-08-23.json"), "id", main.SensitivePath("digest_home_en"))
+
+		return b.String()
+	}
+
+	out := log()
+	for _, secret := range []string{"smtp-password", "auth-token", "1234567890", "sender@example.com", "me@example.com", "خ"} {
+		require.NotContains(t, out, secret)
+	}
+	require.Contains(t, out, "******7890")
+	require.Contains(t, out, "m***@example.com")
+	require.Contains(t, out, "[REDACTED]")
+	require.Contains(t, out, "[6000 bytes]")
+	require.Contains(t, out, "/cache/barghman/******7890_1_2025-08-23.json")
+	require.Contains(t, out, "id=digest_home_en")
+
+	main.LogSensitive = true
+	t.Cleanup(func() { main.LogSensitive = false })
+
+	out = log()
+	require.NotContains(t, out, "smtp-password")
+	require.NotContains(t, out, "auth-token")
+	require.Contains(t, out, "1234567890")
+	require.Contains(t, out, "me@example.com")
+	require.Contains(t, out, "/cache/barghman/1234567890_1_2025-08-23.json")
+	require.Contains(t, out, "... (3952 more bytes)")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidDailyRange = errors.New("invalid daily range")
+
+// DailyRange is a range of the time of each day in the timezone of the client, e.g. "23:00-07:00",
+// it crosses midnight if it ends before it starts.
+type DailyRange struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// UnmarshalText parses the range, the start and the end are separated by "-" or "–".
+func (q *DailyRange) UnmarshalText(text []byte) error {
+	start, end, ok := strings.Cut(strings.ReplaceAll(string(text), "–", "-"), "-")
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidDailyRange, text)
+	}
+
+	var err error
+	if q.Start, err = parseTimeOfDay(start); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidDailyRange, text)
+	}
+
+	if q.End, err = parseTimeOfDay(end); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidDailyRange, text)
+	}
+
+	if q.Start == q.End {
+		return fmt.Errorf("%w: %q is empty", ErrInvalidDailyRange, text)
+	}
+
+	return nil
+}
+
+func (q DailyRange) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+func (q DailyRange) String() string {
+	if q.IsZero() {
+		return ""
+	}
+
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", int(q.Start.Hours()), int(q.Start.Minutes())%60, int(q.End.Hours()), int(q.End.Minutes())%60)
+}
+
+// IsZero reports whether the range isn't set.
+func (q DailyRange) IsZero() bool {
+	return q.Start == 0 && q.End == 0
+}
+
+// Until returns the end of the range which t is in, in the location of t.
+// It's the zero time if t isn't in the range.
+func (q DailyRange) Until(t time.Time) time.Time {
+	if q.IsZero() {
+		return time.Time{}
+	}
+
+	at := func(day time.Time, d time.Duration) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), int(d.Hours()), int(d.Minutes())%60, 0, 0, t.Location())
+	}
+
+	start, end := at(t, q.Start), at(t, q.End)
+
+	switch {
+	// e.g. 13:00-15:00
+	case q.Start < q.End && !t.Before(start) && t.Before(end):
+		return end
+
+	// e.g. 23:00-07:00, after the start of today's range.
+	case q.Start > q.End && !t.Before(start):
+		return at(t.AddDate(0, 0, 1), q.End)
+
+	// e.g. 23:00-07:00, before the end of yesterday's range.
+	case q.Start > q.End && t.Before(end):
+		return end
+	}
+
+	return time.Time{}
+}
+
+// parseTimeOfDay parses "HH:MM" as the duration since midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	numbers, ok := splitNumbers(value, ":")
+	if !ok || len(numbers) != 2 || numbers[0] > 23 || numbers[1] > 59 {
+		return 0, fmt.Errorf("invalid time of the day %q", value)
+	}
+
+	return time.Duration(numbers[0])*time.Hour + time.Duration(numbers[1])*time.Minute, nil
+}
+
+// quietHoursEnd returns the end of the quiet hours of the client if they're now, in its timezone.
+func (c Clients) quietHoursEnd(now time.Time) time.Time {
+	if c.Location != nil {
+		now = now.In(c.Location)
+	}
+
+	return c.QuietHours.Until(now)
+}
+
+// quietUntil returns the end of the quiet hours of the client if they're now, and the outage
+// doesn't start before they end. The zero time means the outage should be sent now.
+func (c Clients) quietUntil(now time.Time, fc *FileContent) time.Time {
+	until := c.quietHoursEnd(now)
+	if until.IsZero() || fc.StartOutageDateTime.Before(until) {
+		return time.Time{}
+	}
+
+	return until
+}
+
+// Schedule returns the cron job of the client in its timezone.
+func (c Clients) Schedule() string {
+	if c.Location == nil || strings.HasPrefix(c.CronJob, "CRON_TZ=") || strings.HasPrefix(c.CronJob, "TZ=") {
+		return c.CronJob
+	}
+
+	return "CRON_TZ=" + c.Location.String() + " " + c.CronJob
+}
+
+// Overlaps reports whether the range of any day overlaps the time from start until end,
+// in the location of start.
+func (q DailyRange) Overlaps(start, end time.Time) bool {
+	at := func(day time.Time, d time.Duration) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), int(d.Hours()), int(d.Minutes())%60, 0, 0, start.Location())
+	}
+
+	// The range of the day before might cross midnight into the start.
+	for day := start.AddDate(0, 0, -1); !at(day, 0).After(end); day = day.AddDate(0, 0, 1) {
+		from, to := at(day, q.Start), at(day, q.End)
+		if q.Start > q.End {
+			to = at(day.AddDate(0, 0, 1), q.End)
+		}
+
+		if from.Before(end) && to.After(start) {
+			return true
+		}
+	}
+
+	return false
+}
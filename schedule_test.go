@@ -0,0 +1,50 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuietHours(t *testing.T) {
+	var client main.Clients
+	_, err := toml.Decode(`quiet_hours = "23:00–07:00"`, &client)
+	require.NoError(t, err)
+	require.Equal(t, main.DailyRange{Start: 23 * time.Hour, End: 7 * time.Hour}, client.QuietHours)
+	require.Equal(t, "23:00-07:00", client.QuietHours.String())
+
+	for _, value := range []string{"23:00", "23:00-24:00", "07:00-07:00", "ab:00-07:00"} {
+		var q main.DailyRange
+		require.ErrorIs(t, q.UnmarshalText([]byte(value)), main.ErrInvalidDailyRange, value)
+	}
+
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2025, time.August, day, hour, minute, 0, 0, tehran)
+	}
+
+	night := main.DailyRange{Start: 23 * time.Hour, End: 7 * time.Hour}
+	require.Equal(t, at(24, 7, 0), night.Until(at(23, 23, 0)))
+	require.Equal(t, at(23, 7, 0), night.Until(at(23, 3, 30)))
+	require.True(t, night.Until(at(23, 7, 0)).IsZero())
+	require.True(t, night.Until(at(23, 22, 59)).IsZero())
+
+	noon := main.DailyRange{Start: 13 * time.Hour, End: 15 * time.Hour}
+	require.Equal(t, at(23, 15, 0), noon.Until(at(23, 14, 0)))
+	require.True(t, noon.Until(at(23, 15, 0)).IsZero())
+
+	require.True(t, main.DailyRange{}.Until(at(23, 3, 0)).IsZero())
+}
+
+func TestClientSchedule(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	require.Equal(t, "CRON_TZ=Europe/Berlin 0 */2 * * *", main.Clients{CronJob: "0 */2 * * *", Location: berlin}.Schedule())
+	require.Equal(t, "TZ=UTC @daily", main.Clients{CronJob: "TZ=UTC @daily", Location: berlin}.Schedule())
+}
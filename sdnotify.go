@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// notifySocketEnv and watchdogUsecEnv are set by systemd for Type=notify and WatchdogSec=.
+const (
+	notifySocketEnv = "NOTIFY_SOCKET"
+	watchdogUsecEnv = "WATCHDOG_USEC"
+	watchdogPIDEnv  = "WATCHDOG_PID"
+)
+
+// sdNotify sends the state to systemd, e.g. "READY=1". It does nothing if barghman isn't
+// started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv(notifySocketEnv)
+	if len(socket) == 0 {
+		return nil
+	}
+
+	// The sockets which start with "@" are in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+
+	return err
+}
+
+// watchdogInterval returns the WatchdogSec= of the service, it's zero if the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv(watchdogPIDEnv); len(pid) != 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv(watchdogUsecEnv), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog pings systemd twice in each interval while barghman is healthy, so systemd restarts
+// it once it's stuck.
+func Watchdog(ctx context.Context, interval time.Duration, healthy func() bool) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if !healthy() {
+				slog.Warn("barghman is unhealthy, skipping the watchdog ping")
+				continue
+			}
+
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Error("Failed to notify the watchdog", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInsecureConfig  = errors.New("insecure config file")
+	ErrSecretNotFound  = errors.New("secret not found")
+	ErrConflictSecrets = errors.New("secret is set twice")
+)
+
+// credentialsDirectoryEnv is set by systemd to the directory of the LoadCredential= files.
+const credentialsDirectoryEnv = "CREDENTIALS_DIRECTORY"
+
+// redacted replaces the secrets in the logs and in the printed config.
+const redacted = "[REDACTED]"
+
+// Secret is a password or a token of the config, it's never printed or logged.
+type Secret string
+
+func (s Secret) String() string {
+	if len(s) == 0 {
+		return ""
+	}
+
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// envReference matches the references of the environment variables, e.g. "${SMTP_PASSWORD}".
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${NAME} references with the environment variables, a missing
+// variable is an error so an empty secret isn't used by mistake.
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+
+		return v
+	})
+
+	if len(missing) != 0 {
+		return "", fmt.Errorf("%w: environment variable %s isn't set", ErrSecretNotFound, strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
+
+// resolveSecret returns the secret of the value, or of the file if the value is empty. A relative file
+// is looked up in $CREDENTIALS_DIRECTORY if it's set, e.g. "smtp_password" for LoadCredential=smtp_password:...
+func resolveSecret(name string, value Secret, file string) (Secret, error) {
+	if len(value) != 0 && len(file) != 0 {
+		return "", fmt.Errorf("%w: %s and %s_file", ErrConflictSecrets, name, name)
+	}
+
+	if len(file) == 0 {
+		expanded, err := expandEnv(string(value))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+
+		return Secret(expanded), nil
+	}
+
+	path, err := expandEnv(file)
+	if err != nil {
+		return "", fmt.Errorf("%s_file: %w", name, err)
+	}
+
+	if dir, ok := os.LookupEnv(credentialsDirectoryEnv); ok && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s_file: %w", ErrSecretNotFound, name, err)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o004 != 0 {
+		slog.Warn("secret file is readable by everyone", "secret", name, "path", path, "mode", info.Mode().Perm())
+	}
+
+	return Secret(strings.TrimRight(string(content), "\r\n")), nil
+}
+
+// isInlineSecret reports whether the secret is written in the config file itself,
+// instead of referencing an environment variable.
+func isInlineSecret(value Secret) bool {
+	return len(value) != 0 && !envReference.MatchString(string(value))
+}
+
+// checkConfigPermissions refuses the config file which has inline secrets and is readable by everyone,
+// and warns if it's readable by the group.
+func checkConfigPermissions(path string, inlineSecrets bool) error {
+	if !inlineSecrets {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	mode := info.Mode().Perm()
+	if mode&0o004 != 0 {
+		return fmt.Errorf("%w: %s has secrets and is readable by everyone (%s), run \"chmod 600 %s\" or move the secrets to *_file or ${ENV} references",
+			ErrInsecureConfig, path, mode, path)
+	}
+
+	if mode&0o040 != 0 {
+		slog.Warn("config file has secrets and is readable by its group", "path", path, "mode", mode)
+	}
+
+	return nil
+}
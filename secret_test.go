@@ -0,0 +1,83 @@
+package main_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigSecrets(t *testing.T) {
+	dir := t.TempDir()
+
+	credentials := filepath.Join(dir, "credentials")
+	require.NoError(t, os.Mkdir(credentials, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(credentials, "auth_token"), []byte("token-from-systemd\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "password"), []byte("password-from-file\n"), 0o600))
+
+	t.Setenv("CREDENTIALS_DIRECTORY", credentials)
+	t.Setenv("BARGHMAN_REFRESH_TOKEN", "token-from-env")
+
+	path := filepath.Join(dir, "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`
+[smtp.gmail]
+auth_method = "plain"
+password_file = %q
+oauth_refresh_token = "${BARGHMAN_REFRESH_TOKEN}"
+
+[clients.my_client]
+smtp = "gmail"
+auth_token_file = "auth_token"
+`, filepath.Join(dir, "password"))), 0o644))
+
+	config, err := main.LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, main.Secret("password-from-file"), config.SMTP["gmail"].Password)
+	require.Equal(t, main.Secret("token-from-env"), config.SMTP["gmail"].OAuthRefreshToken)
+	require.Equal(t, main.Secret("token-from-systemd"), config.Clients["my_client"].AuthToken)
+
+	// The secrets never show up in the printed config.
+	for _, printed := range []string{fmt.Sprintf("%v", config), fmt.Sprintf("%+v", config), fmt.Sprintf("%#v", *config)} {
+		require.NotContains(t, printed, "password-from-file")
+		require.NotContains(t, printed, "token-from")
+		require.Contains(t, printed, "[REDACTED]")
+	}
+
+	require.NoError(t, os.Chmod(path, 0o600))
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+[clients.my_client]
+auth_token = "${BARGHMAN_MISSING}"
+`), 0o600))
+
+	_, err = main.LoadConfig(path)
+	require.ErrorIs(t, err, main.ErrSecretNotFound)
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+[clients.my_client]
+auth_token = "plaintext"
+auth_token_file = "auth_token"
+`), 0o600))
+
+	_, err = main.LoadConfig(path)
+	require.ErrorIs(t, err, main.ErrConflictSecrets)
+}
+
+func TestLoadConfigPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[clients.my_client]
+auth_token = "plaintext"
+`), 0o644))
+	require.NoError(t, os.Chmod(path, 0o644))
+
+	_, err := main.LoadConfig(path)
+	require.ErrorIs(t, err, main.ErrInsecureConfig)
+
+	require.NoError(t, os.Chmod(path, 0o600))
+	_, err = main.LoadConfig(path)
+	require.NoError(t, err)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var ErrUnhealthy = errors.New("barghman is unhealthy")
+
+const (
+	statusDirName  = "status"
+	statusFileName = "daemon.json"
+
+	// DefaultJobTimeout is how long a run may take before it's reported as stuck.
+	DefaultJobTimeout = time.Hour
+)
+
+// DaemonState is the state of the daemon which is kept on the disk, so the status command can read it.
+type DaemonState struct {
+	// StartedAt is when the cron job of the daemon is started.
+	StartedAt time.Time             `json:"started_at"`
+	Runs      map[string]*RunResult `json:"runs"`
+}
+
+// RunResult is the result of the last run of a client.
+type RunResult struct {
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	LastSuccess time.Time `json:"last_success"`
+	// Error is why the last run failed, it's empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// Running reports whether the run isn't finished yet.
+func (r *RunResult) Running() bool {
+	return r.StartedAt.After(r.FinishedAt)
+}
+
+func statusPath(cachePathDir string) string {
+	return filepath.Join(cachePathDir, statusDirName, statusFileName)
+}
+
+// LoadDaemonState returns the state which is written by the daemon, it's empty if it never ran.
+func LoadDaemonState(cachePathDir string) (*DaemonState, error) {
+	state := &DaemonState{Runs: make(map[string]*RunResult)}
+
+	content, err := os.ReadFile(statusPath(cachePathDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, err
+	}
+
+	if state.Runs == nil {
+		state.Runs = make(map[string]*RunResult)
+	}
+
+	return state, nil
+}
+
+// StateStore records the runs of the clients, it's written on every change.
+type StateStore struct {
+	cachePathDir string
+
+	mu    sync.Mutex
+	state *DaemonState
+}
+
+func NewStateStore(cachePathDir string) (*StateStore, error) {
+	if err := os.MkdirAll(filepath.Join(cachePathDir, statusDirName), 0o700); err != nil {
+		slog.Error("cannot create status directory", "error", err)
+		return nil, err
+	}
+
+	state, err := LoadDaemonState(cachePathDir)
+	if err != nil {
+		// The state is rebuilt by the next runs.
+		slog.Warn("couldn't load the daemon state, starting over", "error", err)
+		state = &DaemonState{Runs: make(map[string]*RunResult)}
+	}
+
+	// The runs which were running when the last daemon stopped never finish.
+	for _, r := range state.Runs {
+		if r.Running() {
+			r.FinishedAt, r.Error = r.StartedAt, "interrupted"
+		}
+	}
+
+	return &StateStore{cachePathDir: cachePathDir, state: state}, nil
+}
+
+// Started records the start of the cron job of the daemon.
+func (s *StateStore) Started(now time.Time) {
+	s.update(func(state *DaemonState) { state.StartedAt = now })
+}
+
+// RunStarted records the start of a run of the client.
+func (s *StateStore) RunStarted(client string, now time.Time) {
+	s.update(func(state *DaemonState) {
+		r := state.run(client)
+		r.StartedAt = now
+	})
+}
+
+// RunFinished records the result of the run of the client.
+func (s *StateStore) RunFinished(client string, now time.Time, err error) {
+	s.update(func(state *DaemonState) {
+		r := state.run(client)
+		r.FinishedAt, r.Error = now, ""
+
+		if err != nil {
+			r.Error = err.Error()
+			return
+		}
+
+		r.LastSuccess = now
+	})
+}
+
+// State returns a copy of the state.
+func (s *StateStore) State() *DaemonState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &DaemonState{StartedAt: s.state.StartedAt, Runs: make(map[string]*RunResult, len(s.state.Runs))}
+	for client, r := range s.state.Runs {
+		run := *r
+		state.Runs[client] = &run
+	}
+
+	return state
+}
+
+func (s *DaemonState) run(client string) *RunResult {
+	r, ok := s.Runs[client]
+	if !ok {
+		r = new(RunResult)
+		s.Runs[client] = r
+	}
+
+	return r
+}
+
+func (s *StateStore) update(f func(state *DaemonState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f(s.state)
+
+	content, err := json.Marshal(s.state)
+	if err != nil {
+		slog.Error("Encode daemon state failed", "error", err)
+		return
+	}
+
+	path := statusPath(s.cachePathDir)
+	if err := os.WriteFile(path+".tmp", content, 0o600); err != nil {
+		slog.Error("Failed to write daemon state", "error", err)
+		return
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		slog.Error("Failed to rename daemon state", "error", err)
+	}
+}
+
+// Status is reported by /healthz, /readyz and the status command.
+type Status struct {
+	// Healthy is false if a run is stuck, or a scheduled run didn't start.
+	Healthy bool `json:"healthy"`
+	// Ready is true once the cron job is started, and the cache and the outbox are usable.
+	Ready       bool                    `json:"ready"`
+	Problems    []string                `json:"problems,omitempty"`
+	StartedAt   time.Time               `json:"started_at"`
+	Clients     map[string]ClientStatus `json:"clients"`
+	OutboxDepth int                     `json:"outbox_depth"`
+	// StateStore is "ok", or why the cache directory isn't writable.
+	StateStore string `json:"state_store"`
+}
+
+type ClientStatus struct {
+	RunResult
+	// NextRun is zero for the clients which only run once.
+	NextRun time.Time `json:"next_run"`
+}
+
+// BuildStatus checks the state of the daemon at now.
+func BuildStatus(config Config, cachePathDir string, outbox *Outbox, state *DaemonState, now time.Time) Status {
+	status := Status{StartedAt: state.StartedAt, Clients: make(map[string]ClientStatus), StateStore: "ok"}
+
+	timeout := config.JobTimeout
+	if timeout == 0 {
+		timeout = DefaultJobTimeout
+	}
+
+	for name := range config.Clients {
+		var client ClientStatus
+		if r, ok := state.Runs[name]; ok {
+			client.RunResult = *r
+		}
+
+		if client.Running() && now.Sub(client.StartedAt) > timeout {
+			status.Problems = append(status.Problems, fmt.Sprintf("run of client %s is stuck since %s", name, client.StartedAt.Format(time.DateTime)))
+		}
+
+		if schedule := config.schedule(name); schedule != nil {
+			client.NextRun = schedule.Next(now)
+
+			// The run which is due after the last one, or after the start of the daemon, should have started.
+			since := state.StartedAt
+			if client.StartedAt.After(since) {
+				since = client.StartedAt
+			}
+
+			if due := schedule.Next(since); !since.IsZero() && !client.Running() && now.Sub(due) > timeout {
+				status.Problems = append(status.Problems, fmt.Sprintf("run of client %s which is due at %s didn't start", name, due.Format(time.DateTime)))
+			}
+		}
+
+		status.Clients[name] = client
+	}
+
+	status.Healthy = len(status.Problems) == 0
+
+	entries, outboxErr := outbox.List()
+	if outboxErr != nil {
+		status.Problems = append(status.Problems, fmt.Sprintf("outbox isn't readable: %s", outboxErr))
+	}
+
+	status.OutboxDepth = len(entries)
+
+	storeErr := checkStateStore(cachePathDir)
+	if storeErr != nil {
+		status.StateStore = storeErr.Error()
+		status.Problems = append(status.Problems, fmt.Sprintf("cache isn't writable: %s", storeErr))
+	}
+
+	status.Ready = !state.StartedAt.IsZero() && outboxErr == nil && storeErr == nil
+	slices.Sort(status.Problems)
+
+	return status
+}
+
+// schedule returns the schedule of the client, it's nil if the client only runs once.
+func (c Config) schedule(name string) cron.Schedule {
+	client := c.Clients[name]
+
+	spec := client.Schedule()
+	if len(client.CronJob) == 0 {
+		if len(c.CronJob) == 0 {
+			return nil
+		}
+
+		spec = Clients{CronJob: c.CronJob, Location: c.Location}.Schedule()
+	}
+
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil
+	}
+
+	return schedule
+}
+
+// checkStateStore writes and removes a file in the cache directory.
+func checkStateStore(cachePathDir string) error {
+	f, err := os.CreateTemp(cachePathDir, ".check-*")
+	if err != nil {
+		return err
+	}
+
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// StatusHandler serves the status as json, with 503 if check fails.
+func StatusHandler(status func() Status, check func(Status) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s := status()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !check(s) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if err := json.NewEncoder(w).Encode(s); err != nil {
+			slog.Error("Failed to write status", "error", err)
+		}
+	})
+}
+
+// statusCommand prints the status of the daemon from its state in the cache.
+func statusCommand(w io.Writer, config Config, cachePathDir string, outbox *Outbox) error {
+	state, err := LoadDaemonState(cachePathDir)
+	if err != nil {
+		return err
+	}
+
+	status := BuildStatus(config, cachePathDir, outbox, state, time.Now())
+
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+
+		return t.In(config.Location).Format(time.DateTime)
+	}
+
+	fmt.Fprintf(w, "healthy: %t\nready: %t\nstarted at: %s\noutbox depth: %d\nstate store: %s\n\n",
+		status.Healthy, status.Ready, format(status.StartedAt), status.OutboxDepth, status.StateStore)
+
+	names := make([]string, 0, len(status.Clients))
+	for name := range status.Clients {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT\tNEXT RUN\tLAST RUN\tLAST SUCCESS\tRESULT")
+	for _, name := range names {
+		c := status.Clients[name]
+
+		result := "ok"
+		switch {
+		case c.StartedAt.IsZero():
+			result = "-"
+		case c.Running():
+			result = "running"
+		case len(c.Error) != 0:
+			result = strings.ReplaceAll(c.Error, "\n", "; ")
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, format(c.NextRun), format(c.StartedAt), format(c.LastSuccess), result)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, problem := range status.Problems {
+		fmt.Fprintln(w, "problem:", problem)
+	}
+
+	if !status.Healthy {
+		return ErrUnhealthy
+	}
+
+	return nil
+}
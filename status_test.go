@@ -0,0 +1,164 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildStatus(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	config := main.Config{
+		CronJob:    "@hourly",
+		Location:   time.UTC,
+		JobTimeout: 10 * time.Minute,
+		Clients: map[string]main.Clients{
+			"home":   {Location: time.UTC},
+			"office": {Location: time.UTC, CronJob: "*/5 * * * *"},
+		},
+	}
+
+	now := time.Date(2025, time.August, 23, 10, 30, 0, 0, time.UTC)
+	state := &main.DaemonState{
+		StartedAt: now.Add(-2 * time.Hour),
+		Runs: map[string]*main.RunResult{
+			"home":   {StartedAt: now.Add(-30 * time.Minute), FinishedAt: now.Add(-29 * time.Minute), LastSuccess: now.Add(-29 * time.Minute)},
+			"office": {StartedAt: now.Add(-time.Minute), FinishedAt: now.Add(-time.Minute + time.Second), Error: "auth token is expired"},
+		},
+	}
+
+	status := main.BuildStatus(config, cachePathDir, outbox, state, now)
+	require.True(t, status.Healthy, status.Problems)
+	require.True(t, status.Ready)
+	require.Equal(t, "ok", status.StateStore)
+	require.Equal(t, now.Add(30*time.Minute), status.Clients["home"].NextRun)
+	require.Equal(t, now.Add(5*time.Minute), status.Clients["office"].NextRun)
+	require.Equal(t, "auth token is expired", status.Clients["office"].Error)
+
+	// A run which takes longer than the timeout is stuck.
+	state.Runs["office"] = &main.RunResult{StartedAt: now.Add(-time.Hour)}
+	status = main.BuildStatus(config, cachePathDir, outbox, state, now)
+	require.False(t, status.Healthy)
+	require.Equal(t, []string{"run of client office is stuck since 2025-08-23 09:30:00"}, status.Problems)
+
+	// The run which is due at 09:00 never started.
+	state.Runs["office"] = &main.RunResult{}
+	state.Runs["home"] = &main.RunResult{StartedAt: now.Add(-2 * time.Hour), FinishedAt: now.Add(-2 * time.Hour)}
+	status = main.BuildStatus(config, cachePathDir, outbox, state, now)
+	require.False(t, status.Healthy)
+	require.Contains(t, status.Problems, "run of client home which is due at 2025-08-23 09:00:00 didn't start")
+
+	// The daemon isn't started.
+	status = main.BuildStatus(config, cachePathDir, outbox, &main.DaemonState{}, now)
+	require.True(t, status.Healthy)
+	require.False(t, status.Ready)
+}
+
+func TestStateStore(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+	now := time.Date(2025, time.August, 23, 10, 0, 0, 0, time.UTC)
+
+	store, err := main.NewStateStore(cachePathDir)
+	require.NoError(t, err)
+
+	store.Started(now)
+	store.RunStarted("home", now)
+	store.RunFinished("home", now.Add(time.Second), nil)
+	store.RunStarted("home", now.Add(time.Hour))
+	store.RunFinished("home", now.Add(time.Hour+time.Second), errors.New("provider is down"))
+	store.RunStarted("office", now.Add(time.Hour))
+
+	state, err := main.LoadDaemonState(cachePathDir)
+	require.NoError(t, err)
+	require.Equal(t, now, state.StartedAt.UTC())
+	require.Equal(t, now.Add(time.Second), state.Runs["home"].LastSuccess.UTC())
+	require.Equal(t, "provider is down", state.Runs["home"].Error)
+	require.True(t, state.Runs["office"].Running())
+
+	// The run of the stopped daemon isn't running anymore.
+	store, err = main.NewStateStore(cachePathDir)
+	require.NoError(t, err)
+	require.False(t, store.State().Runs["office"].Running())
+	require.Equal(t, "interrupted", store.State().Runs["office"].Error)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	status := main.Status{Healthy: true}
+	server := httptest.NewServer(main.NewServeMux(func() main.Status { return status }))
+	t.Cleanup(server.Close)
+
+	get := func(path string) int {
+		response, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		return response.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, get("/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	status.Ready = true
+	require.Equal(t, http.StatusOK, get("/readyz"))
+
+	status.Healthy = false
+	require.Equal(t, http.StatusServiceUnavailable, get("/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+}
+
+func TestStatusCommand(t *testing.T) {
+	cachePathDir := t.TempDir() + "/"
+
+	outbox, err := main.NewOutbox(cachePathDir, time.Minute, time.Hour)
+	require.NoError(t, err)
+
+	store, err := main.NewStateStore(cachePathDir)
+	require.NoError(t, err)
+
+	store.Started(time.Now())
+	store.RunStarted("home", time.Now())
+	store.RunFinished("home", time.Now(), errors.New("provider is down"))
+
+	config := main.Config{CronJob: "@daily", Location: time.UTC, Clients: map[string]main.Clients{"home": {Location: time.UTC}}}
+
+	var b bytes.Buffer
+	require.NoError(t, main.RunCommand(&b, []string{"status"}, config, cachePathDir, time.UTC, outbox))
+	require.Contains(t, b.String(), "healthy: true\n")
+	require.Contains(t, b.String(), "outbox depth: 0\n")
+	require.Contains(t, b.String(), "provider is down")
+}
+
+func TestWatchdog(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go main.Watchdog(ctx, 20*time.Millisecond, func() bool { return true })
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "WATCHDOG=1", string(b[:n]))
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	ptime "github.com/yaa110/go-persian-calendar"
+)
+
+//go:embed templates
+var templatesFS embed.FS
+
+// TemplateFiles are the paths of the custom templates, the built-in template is used for the empty ones.
+type TemplateFiles struct {
+	Subject     string `toml:"subject_file"`
+	Summary     string `toml:"summary_file"`
+	Description string `toml:"description_file"`
+	Text        string `toml:"text_file"`
+	HTML        string `toml:"html_file"`
+	// Digest templates are used by the clients in the digest mode.
+	DigestSubject string `toml:"digest_subject_file"`
+	DigestText    string `toml:"digest_text_file"`
+	DigestHTML    string `toml:"digest_html_file"`
+}
+
+// Merge returns the template files, overridden by the non-empty fields of other.
+func (f TemplateFiles) Merge(other TemplateFiles) TemplateFiles {
+	if len(other.Subject) != 0 {
+		f.Subject = other.Subject
+	}
+
+	if len(other.Summary) != 0 {
+		f.Summary = other.Summary
+	}
+
+	if len(other.Description) != 0 {
+		f.Description = other.Description
+	}
+
+	if len(other.Text) != 0 {
+		f.Text = other.Text
+	}
+
+	if len(other.HTML) != 0 {
+		f.HTML = other.HTML
+	}
+
+	if len(other.DigestSubject) != 0 {
+		f.DigestSubject = other.DigestSubject
+	}
+
+	if len(other.DigestText) != 0 {
+		f.DigestText = other.DigestText
+	}
+
+	if len(other.DigestHTML) != 0 {
+		f.DigestHTML = other.DigestHTML
+	}
+
+	return f
+}
+
+// Templates render the subject, the calendar event and the bodies of the email.
+type Templates struct {
+	Subject     *texttemplate.Template
+	Summary     *texttemplate.Template
+	Description *texttemplate.Template
+	Text        *texttemplate.Template
+	HTML        *htmltemplate.Template
+
+	DigestSubject *texttemplate.Template
+	DigestText    *texttemplate.Template
+	DigestHTML    *htmltemplate.Template
+}
+
+// RenderedEmail is the result of executing the templates.
+type RenderedEmail struct {
+	Subject     string
+	Summary     string
+	Description string
+	Text        string
+	HTML        string
+}
+
+var templateFuncs = map[string]any{
+	// jalali formats the time in the Jalali calendar, e.g. {{jalali .StartOutageDateTime "yyyy/MM/dd"}}.
+	"jalali": func(t time.Time, layout string) string { return ptime.New(t).Format(layout) },
+	// gregorian formats the time with a Go layout, e.g. {{gregorian .StartOutageDateTime "2006-01-02"}}.
+	"gregorian": func(t time.Time, layout string) string { return t.Format(layout) },
+	// duration formats a time.Duration in English, .Duration is formatted in the locale of the email.
+	"duration": LocaleEnglish.Duration,
+	"join":     strings.Join,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+}
+
+// defaultTemplates are the built-in templates of each locale.
+var defaultTemplates = func() map[Locale]*Templates {
+	templates := make(map[Locale]*Templates, len(localeValues))
+	for _, locale := range localeValues {
+		t, err := LoadTemplates(TemplateFiles{}, locale)
+		if err != nil {
+			panic(err)
+		}
+
+		templates[locale] = t
+	}
+
+	return templates
+}()
+
+// LoadTemplates parses the template files, and falls back to the built-in templates
+// of the locale for the empty ones.
+func LoadTemplates(files TemplateFiles, locale Locale) (*Templates, error) {
+	var (
+		t   Templates
+		err error
+	)
+
+	if t.Subject, err = parseTextTemplate(locale, "subject", files.Subject); err != nil {
+		return nil, err
+	}
+
+	if t.Summary, err = parseTextTemplate(locale, "summary", files.Summary); err != nil {
+		return nil, err
+	}
+
+	if t.Description, err = parseTextTemplate(locale, "description", files.Description); err != nil {
+		return nil, err
+	}
+
+	if t.Text, err = parseTextTemplate(locale, "invite.txt", files.Text); err != nil {
+		return nil, err
+	}
+
+	if t.HTML, err = parseHTMLTemplate(locale, "invite.html", files.HTML); err != nil {
+		return nil, err
+	}
+
+	if t.DigestSubject, err = parseTextTemplate(locale, "digest.subject", files.DigestSubject); err != nil {
+		return nil, err
+	}
+
+	if t.DigestText, err = parseTextTemplate(locale, "digest.txt", files.DigestText); err != nil {
+		return nil, err
+	}
+
+	if t.DigestHTML, err = parseHTMLTemplate(locale, "digest.html", files.DigestHTML); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func parseHTMLTemplate(locale Locale, name, path string) (*htmltemplate.Template, error) {
+	builtin := "templates/" + string(locale) + "/" + name + ".tmpl"
+
+	var (
+		t   *htmltemplate.Template
+		err error
+	)
+
+	if len(path) != 0 {
+		t, err = htmltemplate.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+	} else {
+		t, err = htmltemplate.New(filepath.Base(builtin)).Funcs(templateFuncs).ParseFS(templatesFS, builtin)
+	}
+
+	if err != nil {
+		slog.Error("Failed to parse template", "error", err, "template", name, "path", path)
+		return nil, fmt.Errorf("%s template: %w", name, err)
+	}
+
+	return t, nil
+}
+
+func parseTextTemplate(locale Locale, name, path string) (*texttemplate.Template, error) {
+	builtin := "templates/" + string(locale) + "/" + name + ".tmpl"
+
+	var (
+		t   *texttemplate.Template
+		err error
+	)
+
+	if len(path) != 0 {
+		t, err = texttemplate.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+	} else {
+		t, err = texttemplate.New(filepath.Base(builtin)).Funcs(templateFuncs).ParseFS(templatesFS, builtin)
+	}
+
+	if err != nil {
+		slog.Error("Failed to parse template", "error", err, "template", name, "path", path)
+		return nil, fmt.Errorf("%s template: %w", name, err)
+	}
+
+	return t, nil
+}
+
+// Render executes all the templates with the data.
+func (t *Templates) Render(data TemplateData) (*RenderedEmail, error) {
+	var (
+		rendered RenderedEmail
+		err      error
+	)
+
+	if rendered.Subject, err = execute(t.Subject, data); err != nil {
+		return nil, fmt.Errorf("subject template: %w", err)
+	}
+
+	// Headers can't have line breaks.
+	rendered.Subject = strings.Join(strings.Fields(rendered.Subject), " ")
+
+	if rendered.Summary, err = execute(t.Summary, data); err != nil {
+		return nil, fmt.Errorf("summary template: %w", err)
+	}
+
+	rendered.Summary = strings.TrimSpace(rendered.Summary)
+
+	if rendered.Description, err = execute(t.Description, data); err != nil {
+		return nil, fmt.Errorf("description template: %w", err)
+	}
+
+	rendered.Description = strings.TrimSpace(rendered.Description)
+
+	if rendered.Text, err = execute(t.Text, data); err != nil {
+		return nil, fmt.Errorf("text template: %w", err)
+	}
+
+	if rendered.HTML, err = execute(t.HTML, data); err != nil {
+		return nil, fmt.Errorf("html template: %w", err)
+	}
+
+	return &rendered, nil
+}
+
+// RenderDigest executes the digest templates with the data, the rendered email has no calendar event.
+func (t *Templates) RenderDigest(data DigestData) (*RenderedEmail, error) {
+	var (
+		rendered RenderedEmail
+		err      error
+	)
+
+	if rendered.Subject, err = execute(t.DigestSubject, data); err != nil {
+		return nil, fmt.Errorf("digest subject template: %w", err)
+	}
+
+	rendered.Subject = strings.Join(strings.Fields(rendered.Subject), " ")
+
+	if rendered.Text, err = execute(t.DigestText, data); err != nil {
+		return nil, fmt.Errorf("digest text template: %w", err)
+	}
+
+	if rendered.HTML, err = execute(t.DigestHTML, data); err != nil {
+		return nil, fmt.Errorf("digest html template: %w", err)
+	}
+
+	return &rendered, nil
+}
+
+func execute(t interface {
+	Execute(w io.Writer, data any) error
+}, data any) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Validate renders the templates with sample data, it catches the errors which
+// only happen on execution, e.g. a field that doesn't exist.
+func (t *Templates) Validate(locale Locale) error {
+	start := time.Date(2025, time.August, 23, 9, 0, 0, 0, time.UTC)
+
+	fc := &FileContent{
+		UID:                 "1234567890_1_2025-08-23",
+		BillID:              "1234567890",
+		OutageNumber:        1,
+		FarsiOutageDate:     "1404/06/01",
+		StartOutageDateTime: start,
+		EndOutageDateTime:   start.Add(2 * time.Hour),
+		Recipients:          []string{"someone@example.com"},
+		Address:             "HOME SWEET HOME",
+		ReasonOutage:        "مدیریت انرژی",
+	}
+
+	if _, err := t.Render(TemplateData{FileContent: fc, Client: "my_client", Location: time.UTC, Locale: locale}); err != nil {
+		return err
+	}
+
+	_, err := t.RenderDigest(NewDigestData([]*FileContent{fc}, "my_client", time.UTC, locale))
+
+	return err
+}
+
+// TemplateData is passed to the email templates.
+type TemplateData struct {
+	*FileContent
+	// Client is the name of the client, e.g. "my_client" for [clients.my_client].
+	Client   string
+	Location *time.Location
+	Locale   Locale
+	// Cancelled is true if the email cancels the event, e.g. for a removed recipient.
+	Cancelled bool
+}
+
+func (d TemplateData) start() time.Time {
+	return d.StartOutageDateTime.In(d.Location)
+}
+
+func (d TemplateData) end() time.Time {
+	return d.EndOutageDateTime.In(d.Location)
+}
+
+// JalaliDate returns the date of the outage in the Jalali calendar, e.g. "1404/06/01" or "۱۴۰۴/۰۶/۰۱".
+func (d TemplateData) JalaliDate() string {
+	return d.Locale.Digits(ptime.New(d.start()).Format("yyyy/MM/dd"))
+}
+
+// JalaliLongDate returns the date of the outage with the names of the weekday and the month,
+// e.g. "Shanbeh 1 Shahrivar 1404" or "شنبه ۱ شهریور ۱۴۰۴".
+func (d TemplateData) JalaliLongDate() string {
+	t := ptime.New(d.start())
+	return d.Locale.Digits(fmt.Sprintf("%s %d %s %d", d.JalaliWeekday(), t.Day(), d.JalaliMonth(), t.Year()))
+}
+
+// JalaliWeekday returns the name of the weekday, e.g. "Shanbeh" or "شنبه".
+func (d TemplateData) JalaliWeekday() string {
+	return d.Locale.JalaliWeekday(ptime.New(d.start()).Weekday())
+}
+
+// JalaliMonth returns the name of the month, e.g. "Shahrivar" or "شهریور".
+func (d TemplateData) JalaliMonth() string {
+	return d.Locale.JalaliMonth(ptime.New(d.start()).Month())
+}
+
+// GregorianDate returns the date of the outage in the Gregorian calendar,
+// e.g. "Saturday, 23 August 2025" or "۲۰۲۵-۰۸-۲۳".
+func (d TemplateData) GregorianDate() string {
+	if d.Locale == LocalePersian {
+		return d.Locale.Digits(d.start().Format(time.DateOnly))
+	}
+
+	return d.start().Format("Monday, 2 January 2006")
+}
+
+func (d TemplateData) StartTime() string {
+	return d.Locale.Digits(d.start().Format("15:04"))
+}
+
+func (d TemplateData) EndTime() string {
+	return d.Locale.Digits(d.end().Format("15:04"))
+}
+
+// Duration returns how long the outage takes, e.g. "2 hours 30 minutes" or "۲ ساعت و ۳۰ دقیقه".
+func (d TemplateData) Duration() string {
+	return d.Locale.Duration(d.EndOutageDateTime.Sub(d.StartOutageDateTime))
+}
+
+// Bills returns the bills of the outage, e.g. "123, 456" or "۱۲۳، ۴۵۶".
+func (d TemplateData) Bills() string {
+	if d.Locale == LocalePersian {
+		return d.Locale.Digits(strings.Join(d.FileContent.Bills(), "، "))
+	}
+
+	return strings.Join(d.FileContent.Bills(), ", ")
+}
+
+// Number returns the value with the digits of the locale, e.g. {{.Number .OutageNumber}}.
+func (d TemplateData) Number(v any) string {
+	return d.Locale.Digits(fmt.Sprint(v))
+}
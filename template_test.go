@@ -0,0 +1,111 @@
+package main_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+
+	subject := filepath.Join(dir, "subject.tmpl")
+	require.NoError(t, os.WriteFile(subject, []byte(`{{.Client}}: outage on {{jalali .StartOutageDateTime "yyyy/MM/dd"}}
+{{.StartTime}}-{{.EndTime}}`), 0o600))
+
+	html := filepath.Join(dir, "body.html")
+	require.NoError(t, os.WriteFile(html, []byte(`<p>{{.Address}}</p>`), 0o600))
+
+	templates, err := main.LoadTemplates(main.TemplateFiles{Subject: subject, HTML: html}, main.LocaleEnglish)
+	require.NoError(t, err)
+	require.NoError(t, templates.Validate(main.LocaleEnglish))
+
+	start := time.Date(2025, time.August, 23, 9, 0, 0, 0, time.UTC)
+	rendered, err := templates.Render(main.TemplateData{
+		FileContent: &main.FileContent{
+			StartOutageDateTime: start,
+			EndOutageDateTime:   start.Add(90 * time.Minute),
+			Address:             "<b>HOME</b>",
+		},
+		Client:   "my_client",
+		Location: time.UTC,
+		Locale:   main.LocaleEnglish,
+	})
+	require.NoError(t, err)
+
+	// The subject is a single line, and the html is escaped.
+	require.Equal(t, "my_client: outage on 1404/06/01 09:00-10:30", rendered.Subject)
+	require.Equal(t, "<p>&lt;b&gt;HOME&lt;/b&gt;</p>", rendered.HTML)
+
+	// The built-in templates are used for the other ones.
+	require.Equal(t, "Power Outage on <b>HOME</b>", rendered.Summary)
+	require.Contains(t, rendered.Text, "1 hour 30 minutes")
+}
+
+func TestTemplatesValidate(t *testing.T) {
+	summary := filepath.Join(t.TempDir(), "summary.tmpl")
+	require.NoError(t, os.WriteFile(summary, []byte(`{{.NotExists}}`), 0o600))
+
+	templates, err := main.LoadTemplates(main.TemplateFiles{Summary: summary}, main.LocalePersian)
+	require.NoError(t, err)
+	require.ErrorContains(t, templates.Validate(main.LocalePersian), "summary template")
+
+	require.NoError(t, os.WriteFile(summary, []byte(`{{.Address`), 0o600))
+	_, err = main.LoadTemplates(main.TemplateFiles{Summary: summary}, main.LocaleEnglish)
+	require.Error(t, err)
+}
+
+func TestPersianLocale(t *testing.T) {
+	templates, err := main.LoadTemplates(main.TemplateFiles{}, main.LocalePersian)
+	require.NoError(t, err)
+
+	start := time.Date(2025, time.August, 23, 9, 0, 0, 0, time.UTC)
+	data := main.TemplateData{
+		FileContent: &main.FileContent{
+			BillID:              "1234",
+			StartOutageDateTime: start,
+			EndOutageDateTime:   start.Add(150 * time.Minute),
+			Address:             "HOME",
+		},
+		Client:   "my_client",
+		Location: time.UTC,
+		Locale:   main.LocalePersian,
+	}
+
+	require.Equal(t, "۱۴۰۴/۰۶/۰۱", data.JalaliDate())
+	require.Equal(t, "شنبه ۱ شهریور ۱۴۰۴", data.JalaliLongDate())
+	require.Equal(t, "۲ ساعت و ۳۰ دقیقه", data.Duration())
+
+	rendered, err := templates.Render(data)
+	require.NoError(t, err)
+	require.Equal(t, "خاموشی برنامه‌ریزی‌شده‌ی my_client - ۱۴۰۴/۰۶/۰۱", rendered.Subject)
+	require.Contains(t, rendered.HTML, `<html dir="rtl" lang="fa">`)
+	require.Contains(t, rendered.Text, "۰۹:۰۰ تا ۱۱:۳۰")
+	require.Contains(t, rendered.Text, "۱۲۳۴")
+
+	data.Locale = main.LocaleEnglish
+	require.Equal(t, "Shanbeh 1 Shahrivar 1404", data.JalaliLongDate())
+}
+
+func TestRecipientGroups(t *testing.T) {
+	client := main.Clients{
+		Locale:           main.LocaleEnglish,
+		RecipientLocales: map[string]main.Locale{"b@example.com": main.LocalePersian, "d@example.com": main.LocalePersian},
+	}
+
+	require.Equal(t, []main.RecipientGroup{
+		{Locale: main.LocaleEnglish, Recipients: []string{"a@example.com", "c@example.com"}},
+		{Locale: main.LocalePersian, Recipients: []string{"b@example.com", "d@example.com"}},
+	}, client.RecipientGroups([]string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}))
+
+	client.Mode = "individual"
+	require.Equal(t, []main.RecipientGroup{
+		{Locale: main.LocaleEnglish, Recipients: []string{"a@example.com"}},
+		{Locale: main.LocalePersian, Recipients: []string{"b@example.com"}},
+		{Locale: main.LocaleEnglish, Recipients: []string{"c@example.com"}},
+	}, client.RecipientGroups([]string{"a@example.com", "b@example.com", "c@example.com"}))
+}
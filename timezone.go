@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultTimezone is the timezone of the outages of the provider, the emails use it unless
+// the timezone is configured.
+const DefaultTimezone = "Asia/Tehran"
+
+var ErrInvalidTimezone = errors.New("invalid timezone")
+
+// calendarLocalTimeFormat is the local time of an event, next to its TZID.
+const calendarLocalTimeFormat = "20060102T150405"
+
+// LoadTimezone loads the IANA timezone, e.g. "Asia/Tehran" or "Europe/Berlin". The local timezone
+// of the system isn't accepted, it has no name which the calendar apps know.
+func LoadTimezone(name string) (*time.Location, error) {
+	if len(name) == 0 || name == "Local" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTimezone, name)
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTimezone, err)
+	}
+
+	return loc, nil
+}
+
+// VTimezone generates the VTIMEZONE of the location from the tzdata, with the observance in effect
+// at from and the ones which start until to. The calendar apps show the events at the same wall-clock
+// time with it, even if their own tzdata is different.
+func VTimezone(loc *time.Location, from, to time.Time) string {
+	var b strings.Builder
+	b.WriteString("BEGIN:VTIMEZONE\r\nTZID:" + loc.String() + "\r\n")
+
+	t := from.In(loc)
+	for {
+		name, offset := t.Zone()
+		start, end := t.ZoneBounds()
+
+		// The start of the observance is in the local time of the previous one.
+		offsetFrom, dtstart := offset, "19700101T000000"
+		if !start.IsZero() {
+			_, offsetFrom = start.Add(-time.Second).Zone()
+			dtstart = start.UTC().Add(time.Duration(offsetFrom) * time.Second).Format(calendarLocalTimeFormat)
+		}
+
+		component := "STANDARD"
+		if t.IsDST() {
+			component = "DAYLIGHT"
+		}
+
+		fmt.Fprintf(&b, "BEGIN:%s\r\nDTSTART:%s\r\nTZOFFSETFROM:%s\r\nTZOFFSETTO:%s\r\nTZNAME:%s\r\nEND:%s\r\n",
+			component, dtstart, formatUTCOffset(offsetFrom), formatUTCOffset(offset), name, component)
+
+		if end.IsZero() || end.After(to) {
+			break
+		}
+
+		t = end
+	}
+
+	b.WriteString("END:VTIMEZONE\r\n")
+
+	return b.String()
+}
+
+// formatUTCOffset formats the offset in seconds as the UTC offset of iCalendar, e.g. "+0330".
+func formatUTCOffset(offset int) string {
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+
+	if seconds := offset % 60; seconds != 0 {
+		return fmt.Sprintf("%c%02d%02d%02d", sign, offset/3600, offset%3600/60, seconds)
+	}
+
+	return fmt.Sprintf("%c%02d%02d", sign, offset/3600, offset%3600/60)
+}
@@ -0,0 +1,78 @@
+package main_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTimezone(t *testing.T) {
+	loc, err := main.LoadTimezone("Europe/Berlin")
+	require.NoError(t, err)
+	require.Equal(t, "Europe/Berlin", loc.String())
+
+	for _, name := range []string{"", "Local", "Mars/Olympus"} {
+		_, err := main.LoadTimezone(name)
+		require.ErrorIs(t, err, main.ErrInvalidTimezone, name)
+	}
+}
+
+func TestVTimezone(t *testing.T) {
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	// Iran doesn't observe daylight saving time since 2022.
+	start := time.Date(2025, time.August, 23, 9, 0, 0, 0, tehran)
+	vtimezone := main.VTimezone(tehran, start, start.Add(2*time.Hour))
+	require.Equal(t, 1, strings.Count(vtimezone, "BEGIN:STANDARD"))
+	require.NotContains(t, vtimezone, "BEGIN:DAYLIGHT")
+	require.Contains(t, vtimezone, "TZID:Asia/Tehran\r\n")
+	require.Contains(t, vtimezone, "TZOFFSETTO:+0330\r\n")
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	// The observance of the summer, and the change back to the standard time in October.
+	vtimezone = main.VTimezone(berlin, time.Date(2025, time.August, 23, 0, 0, 0, 0, berlin), time.Date(2025, time.November, 1, 0, 0, 0, 0, berlin))
+	require.Equal(t, "BEGIN:VTIMEZONE\r\nTZID:Europe/Berlin\r\n"+
+		"BEGIN:DAYLIGHT\r\nDTSTART:20250330T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\nTZNAME:CEST\r\nEND:DAYLIGHT\r\n"+
+		"BEGIN:STANDARD\r\nDTSTART:20251026T030000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\nTZNAME:CET\r\nEND:STANDARD\r\n"+
+		"END:VTIMEZONE\r\n", vtimezone)
+
+	vtimezone = main.VTimezone(time.UTC, start, start.Add(2*time.Hour))
+	require.Contains(t, vtimezone, "DTSTART:19700101T000000\r\nTZOFFSETFROM:+0000\r\nTZOFFSETTO:+0000\r\n")
+}
+
+func TestMailBuildTimezone(t *testing.T) {
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	fc, err := main.Data{
+		OutageDate:      "1404/06/01",
+		OutageStartTime: "09:00",
+		OutageStopTime:  "11:30",
+		Address:         "HOME SWEET HOME",
+		OutageNumber:    218775,
+	}.ToFileContent(tehran, "123", []string{"someone@example.com"}, 0)
+	require.NoError(t, err)
+
+	// The outage is parsed in Tehran, and shown in Berlin.
+	mail := main.NewMailClient(main.SMTP{Mail: "barghman@example.com", From: "Barghman"}, berlin, t.TempDir())
+	calendar, err := mail.Calendar(fc, &main.RenderedEmail{Summary: "Outage"}, main.CalendarMethodRequest)
+	require.NoError(t, err)
+	require.Contains(t, calendar, "BEGIN:VTIMEZONE\r\nTZID:Europe/Berlin\r\n")
+	require.Contains(t, calendar, "DTSTART;TZID=Europe/Berlin:20250823T073000\r\n")
+	require.Contains(t, calendar, "DTEND;TZID=Europe/Berlin:20250823T100000\r\n")
+	require.Less(t, strings.Index(calendar, "END:VTIMEZONE"), strings.Index(calendar, "BEGIN:VEVENT"))
+
+	msg, err := mail.Build(context.Background(), fc, "my_client", main.LocaleEnglish)
+	require.NoError(t, err)
+	require.Contains(t, msg, "07:30 - 10:00")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"time"
+)
+
+type tlsMode string
+
+const (
+	// tlsModeStartTLS connects in plaintext and upgrades the connection with STARTTLS, usually on port 587.
+	tlsModeStartTLS tlsMode = "starttls"
+	// tlsModeImplicit starts TLS right after the TCP connection (SMTPS), usually on port 465.
+	tlsModeImplicit tlsMode = "implicit"
+	// tlsModeNone never uses TLS, only for local relays.
+	tlsModeNone tlsMode = "none"
+	// tlsModeOpportunistic uses STARTTLS only if the server advertises it.
+	tlsModeOpportunistic tlsMode = "opportunistic"
+)
+
+var tlsModeValues = []tlsMode{tlsModeStartTLS, tlsModeImplicit, tlsModeNone, tlsModeOpportunistic}
+
+var ErrSTARTTLSNotSupported = errors.New("smtp server doesn't support STARTTLS")
+
+// TLSConfig builds the tls config of the smtp server, including the custom CA bundle and the client certificate.
+func (s SMTP) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: s.Address, InsecureSkipVerify: s.SkipTLS}
+
+	if len(s.CAFile) != 0 {
+		pem, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", s.CAFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if len(s.CertFile) != 0 || len(s.KeyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// timeoutConn extends the deadline of the connection on every read and write,
+// so a hung server can't block the job forever.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if err := c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
+
+// dial connects to the smtp server based on the tls mode and authenticates the client.
+func (m Mail) dial(ctx context.Context) (*smtp.Client, error) {
+	address := net.JoinHostPort(m.Config.Address, m.Config.Port)
+
+	tlsConfig, err := m.Config.TLSConfig()
+	if err != nil {
+		slog.ErrorContext(ctx, "invalid tls config", "error", err)
+		return nil, err
+	}
+
+	rawConn, err := net.DialTimeout("tcp", address, m.Config.DialTimeout)
+	if err != nil {
+		slog.ErrorContext(ctx, "can't dial the server", "error", err, "address", address)
+		return nil, err
+	}
+
+	var conn net.Conn = &timeoutConn{Conn: rawConn, timeout: m.Config.CommandTimeout}
+
+	if m.Config.TLSMode == tlsModeImplicit {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			slog.ErrorContext(ctx, "TLS handshake failed", "error", err, "address", address)
+			rawConn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	client, err := smtp.NewClient(conn, m.Config.Address)
+	if err != nil {
+		slog.ErrorContext(ctx, "smtp new client failed", "error", err, "address", address)
+		rawConn.Close()
+		return nil, err
+	}
+
+	switch m.Config.TLSMode {
+	case tlsModeStartTLS, tlsModeOpportunistic:
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			if m.Config.TLSMode == tlsModeStartTLS {
+				slog.ErrorContext(ctx, "can't start TLS", "error", ErrSTARTTLSNotSupported, "address", address)
+				client.Close()
+				return nil, ErrSTARTTLSNotSupported
+			}
+
+			slog.WarnContext(ctx, "smtp server doesn't support STARTTLS, continue without TLS", "address", address)
+			break
+		}
+
+		if err := client.StartTLS(tlsConfig); err != nil {
+			slog.ErrorContext(ctx, "can't start TLS", "error", err)
+			client.Close()
+			return nil, err
+		}
+	}
+
+	if m.Auth != nil {
+		auth := m.Auth
+		if a, ok := auth.(*xoauth2Auth); ok {
+			auth = a.withContext(ctx)
+		}
+
+		if err := client.Auth(auth); err != nil {
+			slog.ErrorContext(ctx, "client auth failed", "error", err)
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"strings"
+	"unicode/utf8"
 )
 
 // generateBoundary creates a random MIME boundary string.
@@ -14,3 +16,37 @@ func generateBoundary() string {
 	}
 	return "boundary_" + hex.EncodeToString(b)
 }
+
+// foldCalendarLines folds the lines of the iCalendar content which are longer than
+// 75 octets (RFC 5545), without breaking the multi-byte characters.
+func foldCalendarLines(content string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(content, "\r\n") {
+		line = strings.TrimSuffix(line, "\r\n")
+		if len(line) == 0 {
+			continue
+		}
+
+		limit := 75
+		for len(line) > limit {
+			cut := limit
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+
+			b.WriteString(line[:cut] + "\r\n ")
+			line = line[cut:]
+			// The leading space of the next line is counted too.
+			limit = 74
+		}
+
+		b.WriteString(line + "\r\n")
+	}
+
+	return b.String()
+}
+
+// escapeCalendarText escapes a TEXT value of iCalendar (RFC 5545).
+func escapeCalendarText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
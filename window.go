@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	// DefaultLookaheadDays is the number of the days after today which the outages are fetched for.
+	DefaultLookaheadDays = 5
+	// DefaultLookbackDays is the number of the days before today which the outages are fetched for.
+	DefaultLookbackDays = 1
+	// DefaultMaxRangeDays is the number of the days which the provider returns in one request.
+	DefaultMaxRangeDays = 7
+)
+
+// Window is the range of the days which the outages are fetched for, To isn't included.
+type Window struct {
+	From time.Time
+	To   time.Time
+}
+
+// OutageWindow returns the window from the start of lookback days before today until the end of lookahead
+// days after today in the location. The Jalali days start at midnight, as the Gregorian ones.
+func OutageWindow(now time.Time, loc *time.Location, lookback, lookahead int) Window {
+	now = now.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	return Window{From: today.AddDate(0, 0, -lookback), To: today.AddDate(0, 0, lookahead+1)}
+}
+
+// Overlaps reports whether the outage from start until end happens in the window.
+func (w Window) Overlaps(start, end time.Time) bool {
+	return end.After(w.From) && start.Before(w.To)
+}
+
+// Chunks splits the window into the whole days of the location, at most days days in each one.
+// The first and the last chunk cover the days of the location which the window starts and ends in.
+func (w Window) Chunks(loc *time.Location, days int) []Window {
+	from, last := w.From.In(loc), w.To.Add(-time.Nanosecond).In(loc)
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	to := time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+
+	var chunks []Window
+	for from.Before(to) {
+		end := from.AddDate(0, 0, days)
+		if end.After(to) {
+			end = to
+		}
+
+		chunks = append(chunks, Window{From: from, To: end})
+		from = end
+	}
+
+	return chunks
+}
+
+// PlannedBlackOutWindow calls PlannedBlackOut for each chunk of the window, the dates of the requests
+// are in the location of the provider. An outage which is returned by two chunks is kept once.
+func PlannedBlackOutWindow(ctx context.Context, authToken, billID string, window Window, loc *time.Location, maxDays int) ([]Data, error) {
+	var data []Data
+	seen := make(map[int]bool)
+	for _, chunk := range window.Chunks(loc, maxDays) {
+		// The provider includes the last day of the request.
+		d, err := PlannedBlackOut(ctx, authToken, billID, chunk.From, chunk.To.AddDate(0, 0, -1))
+		if err != nil {
+			slog.ErrorContext(ctx, "PlannedBlackOut failed for a chunk of the window", "error", err, "from", chunk.From, "to", chunk.To)
+			return nil, err
+		}
+
+		for _, outage := range d {
+			if seen[outage.OutageNumber] {
+				continue
+			}
+
+			seen[outage.OutageNumber] = true
+			data = append(data, outage)
+		}
+	}
+
+	return data, nil
+}
+
+// Window returns the window of the outages of the client around now, in its timezone.
+func (c Clients) Window(now time.Time) Window {
+	lookback, lookahead := DefaultLookbackDays, DefaultLookaheadDays
+	if c.LookbackDays != nil {
+		lookback = *c.LookbackDays
+	}
+
+	if c.LookaheadDays != nil {
+		lookahead = *c.LookaheadDays
+	}
+
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	return OutageWindow(now, loc, lookback, lookahead)
+}
@@ -0,0 +1,63 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	main "github.com/dozheiny/barghman"
+	"github.com/stretchr/testify/require"
+	ptime "github.com/yaa110/go-persian-calendar"
+)
+
+func TestOutageWindow(t *testing.T) {
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	// 23:30 of 1404/06/01 in Tehran, it's already the next day in UTC+4:30 and later.
+	now := time.Date(2025, time.August, 23, 23, 30, 0, 0, tehran)
+
+	w := main.OutageWindow(now, tehran, 0, 1)
+	require.Equal(t, time.Date(2025, time.August, 23, 0, 0, 0, 0, tehran), w.From)
+	require.Equal(t, time.Date(2025, time.August, 25, 0, 0, 0, 0, tehran), w.To)
+	require.Equal(t, "1404/06/01", ptime.New(w.From).Format("yyyy/MM/dd"))
+
+	require.True(t, w.Overlaps(now, now.Add(time.Hour)))
+	require.False(t, w.Overlaps(w.To, w.To.Add(time.Hour)))
+	require.False(t, w.Overlaps(w.From.Add(-time.Hour), w.From))
+
+	kabul, err := time.LoadLocation("Asia/Kabul")
+	require.NoError(t, err)
+
+	w = main.OutageWindow(now, kabul, 1, 0)
+	require.Equal(t, time.Date(2025, time.August, 23, 0, 0, 0, 0, kabul), w.From)
+	require.Equal(t, time.Date(2025, time.August, 25, 0, 0, 0, 0, kabul), w.To)
+
+	lookahead := 14
+	w = main.Clients{Location: tehran, LookaheadDays: &lookahead}.Window(now)
+	require.Equal(t, time.Date(2025, time.August, 22, 0, 0, 0, 0, tehran), w.From)
+	require.Equal(t, time.Date(2025, time.September, 7, 0, 0, 0, 0, tehran), w.To)
+}
+
+func TestWindowChunks(t *testing.T) {
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	require.NoError(t, err)
+
+	now := time.Date(2025, time.August, 23, 12, 0, 0, 0, tehran)
+
+	chunks := main.OutageWindow(now, tehran, 1, 14).Chunks(tehran, 7)
+	require.Len(t, chunks, 3)
+	require.Equal(t, time.Date(2025, time.August, 22, 0, 0, 0, 0, tehran), chunks[0].From)
+	require.Equal(t, chunks[0].To, chunks[1].From)
+	require.Equal(t, 7*24*time.Hour, chunks[1].To.Sub(chunks[1].From))
+	require.Equal(t, time.Date(2025, time.September, 7, 0, 0, 0, 0, tehran), chunks[2].To)
+
+	// The days of the window in Berlin start at 01:30 or 02:30 in Tehran, so the requests
+	// cover the next day of Tehran too.
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	chunks = main.OutageWindow(now, berlin, 0, 0).Chunks(tehran, 7)
+	require.Len(t, chunks, 1)
+	require.Equal(t, time.Date(2025, time.August, 23, 0, 0, 0, 0, tehran), chunks[0].From)
+	require.Equal(t, time.Date(2025, time.August, 25, 0, 0, 0, 0, tehran), chunks[0].To)
+}